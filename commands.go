@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// command is a subcommand of testable, e.g. testable gen.
+type command struct {
+	name    string
+	summary string
+	// mode is what the command does with the generated files.
+	mode outputMode
+	// modeFlags are the flags from modeFlagUsage the command takes.
+	modeFlags []string
+}
+
+// commands are testable's subcommands.
+var commands = []command{
+	{"gen", "generate the packages and write them", writeFiles,
+		[]string{"stdout", "watch"}},
+	{"list", "list the files that would be generated", listFiles, nil},
+	{"diff", "print a diff of the generated files against those on disk",
+		diffFiles, nil},
+	{"check", "list the generated files that are out of date", checkFiles,
+		nil},
+	{"report", "print a JSON report of what's wrapped and skipped",
+		reportPackages, nil},
+}
+
+// legacyCommand is used when no subcommand is given, so that the flags
+// of earlier versions, which chose the mode with -stdout, -diff, -check
+// and -report, still work.
+var legacyCommand = command{"", "", writeFiles,
+	[]string{"stdout", "diff", "check", "report", "watch"}}
+
+// modeFlagUsage are the usages of the flags only some commands take,
+// choosing what's done with the generated files.
+var modeFlagUsage = map[string]string{
+	"stdout": "Write the generated files to stdout, each preceded by a " +
+		"// FILE: <path> line",
+	"diff": "Print a diff of the generated files against those on disk " +
+		"instead of writing them, failing if they differ",
+	"check": "List the generated files that are out of date instead of " +
+		"writing them, failing if there are any",
+	"report": "Print a JSON report of what's wrapped of each package " +
+		"and what's skipped, instead of writing the generated files",
+	"watch": "Regenerate whenever the input package's source files change",
+}
+
+// lookupCommand returns the subcommand called name.
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// parseCommand returns the command named by the first of args and the
+// args that follow it. If the first is a flag, the args are the flags of
+// earlier versions and the command is legacyCommand.
+func parseCommand(args []string) (command, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return legacyCommand, args, nil
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		return command{}, nil, usageError{fmt.Errorf("unknown command %q, "+
+			"expected gen, list, diff, check or report", args[0])}
+	}
+	return cmd, args[1:], nil
+}
+
+// addCommandFlags adds cmd's flags to fs, returning the flags every
+// command takes and cmd's mode flags by name.
+func addCommandFlags(cmd command, fs *flag.FlagSet) (*genFlags, map[string]*bool) {
+	f := addGenFlags(fs)
+	modeFlags := make(map[string]*bool)
+	for _, name := range cmd.modeFlags {
+		modeFlags[name] = fs.Bool(name, false, modeFlagUsage[name])
+	}
+	return f, modeFlags
+}
+
+// genFlags are the flags every command takes, describing the packages
+// to generate.
+type genFlags struct {
+	out               *string
+	ifaceOut          *string
+	implOut           *string
+	in                *string
+	buildTag          *string
+	getterPrefix      *string
+	ifacePrefix       *string
+	ifaceSuffix       *string
+	noFieldAccessors  *bool
+	marker            *string
+	parentField       *string
+	quiet             *bool
+	provenance        *bool
+	exclude           *string
+	skipDeprecated    *bool
+	noHeader          *bool
+	noPackage         *bool
+	extraMethods      *stringList
+	maxMethods        *int
+	continueOnError   *bool
+	genFakes          *bool
+	packageDoc        *string
+	forcePointerRecvs *bool
+	safeForward       *bool
+	inPlace           *bool
+	stripPrefix       *string
+	group             *string
+	order             *string
+	exportData        *bool
+	formatWith        *string
+	ifacesOnly        *bool
+	timeout           *time.Duration
+	config            *string
+}
+
+// stringList is the value of a flag that can be given more than once,
+// each of its values.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// addGenFlags defines the flags every command takes in fs.
+func addGenFlags(fs *flag.FlagSet) *genFlags {
+	extraMethods := new(stringList)
+	fs.Var(extraMethods, "extra-method",
+		"Method to add to a struct's interface, as <Struct>.<Method>(<params>) <results>, can be repeated")
+
+	return &genFlags{
+		out: fs.String("output", "", "Output dir"),
+		ifaceOut: fs.String("iface-output", "",
+			"Output dir for the interface packages (default -output)"),
+		implOut: fs.String("impl-output", "",
+			"Output dir for the implementation packages (default -output)"),
+		in: fs.String("input", "", "Package to make testable"),
+		buildTag: fs.String("build-tag", "",
+			"Only build the generated files with this build tag"),
+		getterPrefix: fs.String("getter-prefix", "",
+			"Prefix for the names of field accessors, e.g. Get"),
+		ifacePrefix: fs.String("iface-name-prefix", "",
+			"Prefix for the names of the generated interfaces, e.g. I"),
+		ifaceSuffix: fs.String("iface-name-suffix", "",
+			"Suffix for the names of the generated interfaces, e.g. Interface"),
+		noFieldAccessors: fs.Bool("no-field-accessors", false,
+			"Only wrap methods, leaving out the accessors of exported fields"),
+		noHeader: fs.Bool("no-header", false,
+			"Leave the DO NOT EDIT header out of the generated files"),
+		noPackage: fs.Bool("no-package", false,
+			"Leave the package clause out of the generated files, to splice their declarations into another file"),
+		marker: fs.String("marker-interface", "",
+			"Interface, as <import path>.<Name>, to embed in every generated interface"),
+		parentField: fs.String("parent-field", "parent",
+			"Name of the field holding the wrapped struct in each wrapper"),
+		quiet: fs.Bool("quiet", false, "Only output errors"),
+		provenance: fs.Bool("provenance-comments", false,
+			"Comment each interface method with the member it wraps"),
+		exclude: fs.String("exclude-methods", "",
+			"Comma separated methods to leave out, as <Method> or <Struct>.<Method>"),
+		extraMethods: extraMethods,
+		skipDeprecated: fs.Bool("skip-deprecated", false,
+			"Leave out the structs, fields, methods and functions documented as deprecated"),
+		maxMethods: fs.Int("max-methods", 0,
+			"Skip structs with more methods than this (default no limit)"),
+		continueOnError: fs.Bool("continue-on-error", false,
+			"Keep generating the other packages if one fails, reporting "+
+				"every failure at the end"),
+		genFakes: fs.Bool("gen-fake", false,
+			"Also generate a package of fakes implementing the interfaces"),
+		packageDoc: fs.String("package-doc", "",
+			"Doc comment of the generated packages, following \"Package <name>\""),
+		forcePointerRecvs: fs.Bool("force-pointer-receivers", true,
+			"Give every wrapper method a pointer receiver, otherwise they "+
+				"mirror the receivers of the methods they forward to"),
+		safeForward: fs.Bool("safe-forward", false,
+			"Panic with a clear message when a wrapper with no parent is used"),
+		inPlace: fs.Bool("in-place", false,
+			"Put the generated packages in the input package's directory"),
+		stripPrefix: fs.String("strip-prefix", "",
+			"Prefix to strip from the input package's name when naming the generated packages"),
+		group: fs.String("group", "",
+			"Comma separated structs to generate in their own packages, as <Struct>=<package>"),
+		order: fs.String("order", "source",
+			"Order of the generated methods, source for the order they're declared in or name"),
+		exportData: fs.Bool("export-data", false,
+			"Read the input package's compiled export data instead of its source"),
+		formatWith: fs.String("format-with", "",
+			"Formatter command, e.g. gofumpt, to pipe the generated files through (default gofmt)"),
+		ifacesOnly: fs.Bool("ifaces-only", false,
+			"Only generate the interface packages, not the wrappers"),
+		timeout: fs.Duration("timeout", 0,
+			"Give up if generation takes longer than this (default no timeout)"),
+		config: fs.String("config", "",
+			"JSON file of flag values, flags given on the command line "+
+				"take precedence (default "+defaultConfig+" if it exists)"),
+	}
+}
+
+// options returns the Options the flags describe.
+func (f *genFlags) options() (Options, error) {
+	opts := Options{
+		Input:           *f.in,
+		BuildTag:        *f.buildTag,
+		GetterPrefix:    *f.getterPrefix,
+		IfaceNamePrefix: *f.ifacePrefix,
+		IfaceNameSuffix: *f.ifaceSuffix,
+		ParentField:     *f.parentField,
+		MarkerInterface: *f.marker,
+		IfacesOnly:      *f.ifacesOnly,
+		MaxMethods:      *f.maxMethods,
+		ContinueOnError: *f.continueOnError,
+		GenFakes:        *f.genFakes,
+		PackageDoc:      *f.packageDoc,
+		MirrorReceivers: !*f.forcePointerRecvs,
+		SafeForward:     *f.safeForward,
+		StripPrefix:     *f.stripPrefix,
+		Order:           *f.order,
+		ExportData:      *f.exportData,
+
+		ProvenanceComments: *f.provenance,
+		NoFieldAccessors:   *f.noFieldAccessors,
+		SkipDeprecated:     *f.skipDeprecated,
+		NoHeader:           *f.noHeader,
+		NoPackage:          *f.noPackage,
+	}
+
+	if *f.exclude != "" {
+		opts.ExcludeMethods = strings.Split(*f.exclude, ",")
+	}
+
+	for _, extra := range *f.extraMethods {
+		st, sig, ok := strings.Cut(extra, ".")
+		if !ok {
+			return Options{}, usageError{fmt.Errorf("invalid "+
+				"-extra-method %q, expected <Struct>.<Method>"+
+				"(<params>) <results>", extra)}
+		}
+		if opts.ExtraMethods == nil {
+			opts.ExtraMethods = make(map[string][]string)
+		}
+		st = strings.TrimSpace(st)
+		opts.ExtraMethods[st] = append(opts.ExtraMethods[st], sig)
+	}
+
+	if *f.formatWith != "" {
+		opts.PostProcess = formatWith(*f.formatWith)
+	}
+
+	if *f.group != "" {
+		opts.Groups = make(map[string]string)
+		for _, mapping := range strings.Split(*f.group, ",") {
+			st, pkg, ok := strings.Cut(mapping, "=")
+			if !ok {
+				return Options{}, usageError{fmt.Errorf("invalid "+
+					"-group %q, expected <Struct>=<package>", mapping)}
+			}
+			opts.Groups[strings.TrimSpace(st)] = strings.TrimSpace(pkg)
+		}
+	}
+
+	out := *f.out
+	if *f.inPlace {
+		if out != "" {
+			return Options{}, usageError{errors.New("-in-place and " +
+				"-output can't be used together")}
+		}
+		out = pkgDir(*f.in)
+	}
+
+	var err error
+	opts.Output, opts.BasePkg, err = resolveOutput(out)
+	if err != nil {
+		return Options{}, usageError{err}
+	}
+	if *f.ifaceOut != "" {
+		opts.IfaceOutput, opts.IfaceBasePkg, err = resolveOutput(*f.ifaceOut)
+		if err != nil {
+			return Options{}, usageError{err}
+		}
+	}
+	if *f.implOut != "" {
+		opts.ImplOutput, opts.ImplBasePkg, err = resolveOutput(*f.implOut)
+		if err != nil {
+			return Options{}, usageError{err}
+		}
+	}
+	return opts, nil
+}
+
+// commandUsage returns the usage function of cmd, whose flags are fs.
+func commandUsage(cmd command, fs *flag.FlagSet) func() {
+	return func() {
+		out := fs.Output()
+		if cmd.name == "" {
+			fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n",
+				os.Args[0])
+			for _, cmd := range commands {
+				fmt.Fprintf(out, "  %-6s %s\n", cmd.name, cmd.summary)
+			}
+			fmt.Fprintf(out, "\nRun %s <command> -h for the command's "+
+				"flags.\nThe flags below, given without a command, "+
+				"are deprecated.\n\n", os.Args[0])
+		} else {
+			fmt.Fprintf(out, "Usage: %s %s [flags]\n\n%s.\n\n", os.Args[0],
+				cmd.name, strings.ToUpper(cmd.summary[:1])+cmd.summary[1:])
+		}
+		fs.PrintDefaults()
+		fmt.Fprintf(out, "\nExit codes:\n"+
+			"  %d  invalid flags or input\n"+
+			"  %d  the input package couldn't be read or parsed\n"+
+			"  %d  the code couldn't be generated\n"+
+			"  %d  the generated files couldn't be written\n"+
+			"  %d  the generated files differ from those on disk (diff, check)\n",
+			exitUsage, exitParse, exitGenerate, exitWrite, exitStale)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFlagOptions returns the options gen's flags args describe.
+func testFlagOptions(t *testing.T, args ...string) Options {
+	t.Helper()
+	fs := flag.NewFlagSet("testable gen", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := addGenFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := f.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func TestSeparateOutputs(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	src := filepath.Join(gopath, "src")
+	opts := testFlagOptions(t, "-input", "example.com/foo",
+		"-iface-output", filepath.Join(src, "example.com", "api"),
+		"-impl-output", filepath.Join(src, "example.com", "app", "wrap"))
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+
+	iface := files["example.com/api/fooiface/fooiface.go"]
+	impl := files["example.com/app/wrap/foo/foo.go"]
+	if iface == "" || impl == "" || len(files) != 2 {
+		t.Fatalf("got files %v, want the interfaces in example.com/api "+
+			"and the wrappers in example.com/app/wrap", files)
+	}
+	testContains(t, "the wrappers", impl, `"example.com/api/fooiface"`)
+}
+
+func TestInPlace(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	opts := testFlagOptions(t, "-input", "example.com/foo", "-in-place")
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+
+	impl := files["example.com/foo/foo/foo.go"]
+	if _, ok := files["example.com/foo/fooiface/fooiface.go"]; !ok || impl == "" {
+		t.Fatalf("got files %v, want them in example.com/foo", files)
+	}
+	testContains(t, "the wrappers", impl, `"example.com/foo/fooiface"`)
+}
+
+func TestCommandFlags(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		command string
+		mode    string
+		wantErr bool
+	}{
+		{args: []string{"gen", "-input", "example.com/foo"}, command: "gen"},
+		{args: []string{"gen", "-input", "example.com/foo", "-stdout"}, command: "gen", mode: "stdout"},
+		{args: []string{"list", "-input", "example.com/foo"}, command: "list"},
+		{args: []string{"list", "-input", "example.com/foo", "-stdout"}, command: "list", wantErr: true},
+		{args: []string{"diff", "-input", "example.com/foo"}, command: "diff"},
+		{args: []string{"diff", "-input", "example.com/foo", "-diff"}, command: "diff", wantErr: true},
+		{args: []string{"check", "-input", "example.com/foo"}, command: "check"},
+		{args: []string{"report", "-input", "example.com/foo"}, command: "report"},
+		{args: []string{"-input", "example.com/foo", "-check"}, mode: "check"},
+		{args: []string{"-input", "example.com/foo", "-report"}, mode: "report"},
+	} {
+		cmd, args, err := parseCommand(tt.args)
+		if err != nil {
+			t.Errorf("parseCommand(%q) returned %v", tt.args, err)
+			continue
+		}
+		if cmd.name != tt.command {
+			t.Errorf("parseCommand(%q) returned command %q, want %q",
+				tt.args, cmd.name, tt.command)
+		}
+		fs := flag.NewFlagSet("testable "+cmd.name, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		f, modeFlags := addCommandFlags(cmd, fs)
+		if err := fs.Parse(args); (err != nil) != tt.wantErr {
+			t.Errorf("parsing %q returned %v, want error %t", tt.args, err, tt.wantErr)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if *f.in != "example.com/foo" {
+			t.Errorf("parsing %q set -input to %q", tt.args, *f.in)
+		}
+		for name, set := range modeFlags {
+			if *set != (name == tt.mode) {
+				t.Errorf("parsing %q set -%s to %t", tt.args, name, *set)
+			}
+		}
+	}
+
+	var uerr usageError
+	if _, _, err := parseCommand([]string{"build"}); !errors.As(err, &uerr) {
+		t.Errorf("parseCommand of an unknown command returned %v, want a usage error", err)
+	}
+}
+
+func TestGopathEntries(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	t.Setenv("GOPATH", t.TempDir()+string(filepath.ListSeparator)+gopath)
+	src := filepath.Join(gopath, "src")
+	opts := testFlagOptions(t, "-input", "example.com/foo",
+		"-output", filepath.Join(src, "example.com", "out"))
+	if opts.BasePkg != outPkg {
+		t.Errorf("-output in the second GOPATH entry has the import path %q, want %q",
+			opts.BasePkg, outPkg)
+	}
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+	testContains(t, fooImpl, files[fooImpl], `"example.com/out/fooiface"`)
+
+	opts = testFlagOptions(t, "-input", "example.com/foo", "-in-place")
+	if want := filepath.Join(src, "example.com", "foo"); opts.Output != want {
+		t.Errorf("-in-place outputs to %q, want %q", opts.Output, want)
+	}
+}
+
+func TestInPlaceSourceBuilds(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	opts := testFlagOptions(t, "-input", "example.com/foo", "-in-place")
+	files := testGenerate(t, opts)
+
+	// The source package can use its interfaces, which are in a
+	// subdirectory it doesn't build, without an import cycle.
+	files["example.com/foo/use.go"] = `package foo
+
+import "example.com/foo/fooiface"
+
+func Get(c fooiface.Client) string { return c.Get() }
+`
+	testVet(t, gopath, files)
+}
+
+func TestFormatWith(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("the stub formatter needs sh")
+	}
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": "package foo\n\ntype S struct{}\n\nfunc (s *S) Run() {}\n"},
+	})
+	// The stub marks the files it formats and echoes its argument.
+	stub := filepath.Join(t.TempDir(), "stubfmt")
+	err := os.WriteFile(stub, []byte("#!/bin/sh\necho \"// formatted by stubfmt $1\"\ncat\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testFlagOptions(t, "-input", "example.com/foo",
+		"-output", filepath.Join(gopath, "src", outPkg), "-format-with", stub+" -s")
+	files := testGenerate(t, opts)
+	if len(files) != 2 {
+		t.Errorf("got files %v, want the interfaces and wrappers", files)
+	}
+	for name, src := range files {
+		if !strings.HasPrefix(src, "// formatted by stubfmt -s\n// Auto generated code DO NOT EDIT\n") {
+			t.Errorf("%s wasn't formatted by the stub:\n%s", name, src)
+		}
+	}
+	testVet(t, gopath, files)
+
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	opts = testFlagOptions(t, "-input", "example.com/foo",
+		"-output", filepath.Join(gopath, "src", outPkg), "-format-with", "testable-no-such-formatter")
+	if opts.PostProcess != nil {
+		t.Error("a missing formatter has a PostProcess function")
+	}
+	if !strings.Contains(buf.String(), "formatter testable-no-such-formatter not found, using gofmt") {
+		t.Errorf("got warnings %q, want one that the formatter wasn't found", buf)
+	}
+}
+
+func TestConfigUnknownKey(t *testing.T) {
+	config := filepath.Join(t.TempDir(), defaultConfig)
+	if err := os.WriteFile(config, []byte(`{
+	"input": "example.com/foo",
+	"ouptut": "internal/testable",
+	"ifaces-only": true
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("testable gen", flag.ContinueOnError)
+	addGenFlags(fs)
+	err := applyConfig(fs, config)
+	if err == nil || !strings.Contains(err.Error(), "unknown keys ouptut") {
+		t.Errorf("got error %v, want one naming the key ouptut", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// defaultConfig is the config file used when -config isn't given, if
+// it exists in the working directory.
+const defaultConfig = ".testable.json"
+
+// applyConfig sets the flags of fs that weren't given on the command
+// line to the values in the JSON config file configFile, or
+// defaultConfig if configFile is "". The config is an object mapping flag names to
+// values, e.g. {"output": "internal/testable", "ifaces-only": true}.
+// Flags taking comma separated <key>=<value> pairs, such as group, can
+// be given an object instead, and flags that can be repeated, such as
+// extra-method, an array. Flags of other commands, such as watch,
+// are ignored so that one config works for every command.
+func applyConfig(fs *flag.FlagSet, configFile string) error {
+	if configFile == "" {
+		configFile = defaultConfig
+		if _, err := os.Stat(configFile); os.IsNotExist(err) {
+			return nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %v", configFile, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var unknown []string
+	for name, value := range config {
+		if _, ok := modeFlagUsage[name]; ok && fs.Lookup(name) == nil {
+			continue
+		}
+		if fs.Lookup(name) == nil || name == "config" {
+			unknown = append(unknown, name)
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, value := range values {
+			if err := fs.Set(name, configValue(value)); err != nil {
+				return fmt.Errorf("%s: %s: %v", configFile, name, err)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown keys %s", configFile,
+			strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// configValue returns the flag value for the config value value. An
+// object becomes its <key>=<value> pairs, sorted and comma separated.
+func configValue(value interface{}) string {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Sprint(value)
+	}
+
+	var pairs []string
+	for key, value := range object {
+		pairs = append(pairs, key+"="+fmt.Sprint(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
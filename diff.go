@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+// in a unified diff.
+const diffContext = 3
+
+// diffOp is a line of an edit script: kept (' '), removed ('-') or
+// added ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the unified diff turning before, the contents of
+// the file oldName, into after, the contents of newName. It's "" if
+// they're the same.
+func unifiedDiff(oldName, newName string, before, after []byte) string {
+	if bytes.Equal(before, after) {
+		return ""
+	}
+
+	ops := diffLines(splitLines(before), splitLines(after))
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", oldName, newName)
+	// oldLine and newLine are the line numbers, from 1, of the next
+	// line of each file.
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		// The hunk starts diffContext lines before the change and runs
+		// until there are more than twice that many unchanged lines,
+		// which would be the end of one hunk and the start of the next.
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for unchanged := 0; end < len(ops) && unchanged <= 2*diffContext; end++ {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > i && ops[end-1].kind == ' ' {
+			end--
+		}
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		oldStart, newStart := oldLine-(i-start), newLine-(i-start)
+		var oldCount, newCount int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount),
+			hunkRange(newStart, newCount))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(buf, "%c%s\n", op.kind, op.line)
+		}
+
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				oldLine++
+			}
+			if op.kind != '-' {
+				newLine++
+			}
+		}
+		i = end
+	}
+	return buf.String()
+}
+
+// hunkRange formats the start and length of a hunk's lines in one of
+// the files. An empty range starts at the line before it.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// splitLines splits data into lines without their line endings.
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// diffLines returns the shortest edit script turning a into b. It
+// keeps the lines a and b start and end with, and finds the rest with
+// Myers' algorithm, dividing the scripts at their middle snakes so it
+// takes space linear in the number of lines.
+func diffLines(a, b []string) []diffOp {
+	return appendDiff(nil, a, b)
+}
+
+// appendDiff appends the shortest edit script turning a into b to ops.
+func appendDiff(ops []diffOp, a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	switch {
+	case len(midA) == 0:
+		for _, line := range midB {
+			ops = append(ops, diffOp{'+', line})
+		}
+	case len(midB) == 0:
+		for _, line := range midA {
+			ops = append(ops, diffOp{'-', line})
+		}
+	default:
+		// Neither the start nor the end is kept, so there are at least
+		// two edits and the scripts before and after the middle snake
+		// each have fewer.
+		x, y, u, v := middleSnake(midA, midB)
+		ops = appendDiff(ops, midA[:x], midB[:y])
+		for _, line := range midA[x:u] {
+			ops = append(ops, diffOp{' ', line})
+		}
+		ops = appendDiff(ops, midA[u:], midB[v:])
+	}
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// middleSnake returns the middle snake of a shortest edit script
+// turning a into b, the lines a[x:u], equal to b[y:v], kept halfway
+// through it. It searches for the script from both ends at once,
+// until the searches overlap.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	max := (n + m + 1) / 2
+	// forward[off+k] is how far into a the furthest reaching forward
+	// path on diagonal k, where x-y = k, gets. backward is the same
+	// for the paths from the ends of a and b, on the diagonals of a and
+	// b reversed, where forward diagonal k is backward diagonal
+	// delta-k.
+	off := max + 1
+	forward := make([]int, 2*off+1)
+	backward := make([]int, 2*off+1)
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := forward[off+k+1]
+			if k != -d && (k == d || forward[off+k-1] >= x) {
+				x = forward[off+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[off+k] = x
+			if back := delta - k; delta%2 != 0 && back >= -(d-1) &&
+				back <= d-1 && x+backward[off+back] >= n {
+				return x0, y0, x, y
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			x := backward[off+k+1]
+			if k != -d && (k == d || backward[off+k-1] >= x) {
+				x = backward[off+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			backward[off+k] = x
+			if fwd := delta - k; delta%2 == 0 && fwd >= -d && fwd <= d &&
+				x+forward[off+fwd] >= n {
+				return n - x, m - y, n - x0, m - y0
+			}
+		}
+	}
+	panic("no middle snake")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	before := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\n"
+	after := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\no\n"
+	want := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -12,3 +12,4 @@
+ l
+ m
+ n
++o
+`
+	if got := unifiedDiff("old", "new", []byte(before), []byte(after)); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got := unifiedDiff("old", "new", []byte(before), []byte(before)); got != "" {
+		t.Errorf("the diff of equal files is\n%s", got)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(4)))
+		}
+		return lines
+	}
+
+	for i := 0; i < 1000; i++ {
+		a, b := randomLines(), randomLines()
+		ops := diffLines(a, b)
+
+		var gotA, gotB []string
+		edits := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if strings.Join(gotA, "") != strings.Join(a, "") ||
+			strings.Join(gotB, "") != strings.Join(b, "") {
+			t.Fatalf("the script %v doesn't turn %v into %v", ops, a, b)
+		}
+		if want := len(a) + len(b) - 2*lcsLen(a, b); edits != want {
+			t.Fatalf("the script %v turning %v into %v has %d edits, "+
+				"want %d", ops, a, b, edits, want)
+		}
+	}
+}
+
+// lcsLen returns the length of the longest common subsequence of a and
+// b.
+func lcsLen(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] > lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
+
+func BenchmarkDiffLines(b *testing.B) {
+	// A large generated file with a change every hundred lines.
+	before := make([]string, 50000)
+	after := make([]string, len(before))
+	for i := range before {
+		before[i] = fmt.Sprintf("line %d", i)
+		after[i] = before[i]
+		if i%100 == 0 {
+			after[i] = fmt.Sprintf("changed %d", i)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		diffLines(before, after)
+	}
+}
+
+func TestDiffMode(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	if err := run(opts, 0, writeFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	if out := testStdout(t, func() { err = run(opts, 0, diffFiles) }); err != nil || out != "" {
+		t.Fatalf("diffing the files just written: got error %v and\n%s", err, out)
+	}
+
+	src := filepath.Join(gopath, "src", "example.com", "foo", "foo.go")
+	if err := os.WriteFile(src, []byte(`package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+
+func (c *Client) Put(v string) {}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := testStdout(t, func() { err = run(opts, 0, diffFiles) })
+	if !errors.Is(err, errStale) {
+		t.Errorf("got error %v, want %v", err, errStale)
+	}
+	if !strings.Contains(out, "+\tPut(v string)\n") {
+		t.Errorf("the diff doesn't add Put:\n%s", out)
+	}
+	// Nothing is written.
+	iface := filepath.Join(gopath, "src", outPkg, "fooiface", "fooiface.go")
+	if data, _ := os.ReadFile(iface); strings.Contains(string(data), "Put") {
+		t.Errorf("the diff mode wrote %s", iface)
+	}
+}
+
+func TestCheckMode(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	if err := run(opts, 0, writeFiles); err != nil {
+		t.Fatal(err)
+	}
+	iface := filepath.Join(gopath, "src", outPkg, "fooiface", "fooiface.go")
+	impl := filepath.Join(gopath, "src", outPkg, "foo", "foo.go")
+
+	// Files that are only formatted differently aren't stale.
+	data, err := os.ReadFile(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unformatted := strings.ReplaceAll(string(data), "\t", "  ")
+	if err := os.WriteFile(iface, []byte(unformatted), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out := testStdout(t, func() { err = run(opts, 0, checkFiles) }); err != nil || out != "" {
+		t.Fatalf("checking up to date files: got error %v and\n%s", err, out)
+	}
+
+	src := filepath.Join(gopath, "src", "example.com", "foo", "foo.go")
+	if err := os.WriteFile(src, []byte(`package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+
+func (c *Client) Put(v string) {}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := testStdout(t, func() { err = run(opts, 0, checkFiles) })
+	if !errors.Is(err, errStale) {
+		t.Errorf("got error %v, want %v", err, errStale)
+	}
+	if want := impl + "\n" + iface + "\n"; out != want {
+		t.Errorf("got stale files\n%s\nwant\n%s", out, want)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoPackages is returned when the input has no Go files to wrap.
+var ErrNoPackages = errors.New("no Go files to wrap")
+
+// UnsupportedTypeError is the warning given when a member of the input
+// package is skipped because the generated code can't wrap it, such as
+// a generic type.
+type UnsupportedTypeError struct {
+	// Member is the skipped member, e.g. pkg.List or pkg.Map.Get.
+	Member string
+	// Reason says why the member can't be wrapped.
+	Reason string
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("skipping %s: %s", e.Member, e.Reason)
+}
+
+// UnexportedDependencyError is the warning given when a member of the
+// input package is skipped because it uses an unexported type, which
+// the generated code can't name.
+type UnexportedDependencyError struct {
+	// Member is the skipped field, method or function, e.g.
+	// pkg.Client.Do.
+	Member string
+	// Type is the unexported type it uses.
+	Type string
+}
+
+func (e *UnexportedDependencyError) Error() string {
+	return fmt.Sprintf("skipping %s: it uses the unexported type %s",
+		e.Member, e.Type)
+}
+
+// ReceiverConflictError is returned when a method is declared with a
+// value receiver in one of the input package's files and a pointer
+// receiver in another, as can happen with build-tag variants of a file,
+// so which one the wrapper should forward to is ambiguous.
+type ReceiverConflictError struct {
+	// Method is the conflicting method, e.g. pkg.Client.Do.
+	Method string
+	// ValueFile is the file declaring it with a value receiver.
+	ValueFile string
+	// PointerFile is the file declaring it with a pointer receiver.
+	PointerFile string
+}
+
+func (e *ReceiverConflictError) Error() string {
+	return fmt.Sprintf("%s has a value receiver in %s but a pointer "+
+		"receiver in %s", e.Method, e.ValueFile, e.PointerFile)
+}
+
+// InternalImportError is the warning given when a generated package
+// imports an internal package, such as the input package, that it isn't
+// allowed to because it's outside the tree the package is internal to,
+// so the generated package won't compile.
+type InternalImportError struct {
+	// Importer is the import path of the generated package.
+	Importer string
+	// Package is the import path of the internal package.
+	Package string
+}
+
+func (e *InternalImportError) Error() string {
+	return fmt.Sprintf("%s can't import %s: the output must be under "+
+		"%s to use an internal package", e.Importer, e.Package,
+		internalParent(e.Package))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"go/importer"
+	"go/token"
+	"go/types"
+)
+
+// loadExportData returns the package with the given import path, keyed
+// by its name as for getSubpackages. It's built from the package's
+// export data rather than its source, so packages whose source isn't
+// available, such as binary-only ones, can be wrapped too. Export data
+// has no comments, so the wrappers aren't documented.
+func loadExportData(importPath string) (map[string]*Package, error) {
+	typesPkg, err := importer.ForCompiler(token.NewFileSet(), "gc",
+		nil).Import(importPath)
+	if err != nil {
+		return nil, parseError{fmt.Errorf("loading the export data "+
+			"of %s: %v", importPath, err)}
+	}
+
+	name := typesPkg.Name()
+	d := newPkgDecls()
+	q := d.qualifier(name, typesPkg)
+	scope := typesPkg.Scope()
+	for _, objName := range scope.Names() {
+		switch obj := scope.Lookup(objName).(type) {
+		case *types.Func:
+			if !obj.Exported() {
+				continue
+			}
+			sig := obj.Type().(*types.Signature)
+			if sig.TypeParams().Len() > 0 {
+				d.warn(&UnsupportedTypeError{
+					Member: name + "." + obj.Name(),
+					Reason: "generic functions are not supported",
+				})
+				continue
+			}
+			d.funcs = append(d.funcs, &Function{
+				Name:       obj.Name(),
+				ImportPath: importPath,
+				Params: nameParams(tupleFields(sig.Params(),
+					sig.Variadic(), q)),
+				Results: tupleFields(sig.Results(), false, q),
+			})
+		case *types.TypeName:
+			if !obj.Exported() || obj.IsAlias() {
+				continue
+			}
+			d.typeNames = append(d.typeNames, obj.Name())
+			d.addExportedType(name, obj, q)
+		}
+	}
+
+	return map[string]*Package{
+		name: d.Package(name, importPath),
+	}, nil
+}
+
+// addExportedType collects the exported fields and methods of the type
+// obj of the package pkg, as addFile does for the types declared in a
+// file. Their types are qualified by q. Every struct is collected, as
+// in source, as are other types with methods, along with the type
+// parameters of generic ones. Interfaces are left out.
+func (d *pkgDecls) addExportedType(pkg string, obj *types.TypeName, q types.Qualifier) {
+	named, ok := obj.Type().(*types.Named)
+	if !ok || types.IsInterface(named) {
+		return
+	}
+	if tparams := named.TypeParams(); tparams.Len() > 0 {
+		var params []*Field
+		for i := 0; i < tparams.Len(); i++ {
+			params = append(params, &Field{
+				Name: tparams.At(i).Obj().Name(),
+				Type: types.TypeString(tparams.At(i).Constraint(), q),
+			})
+		}
+		d.typeParams[obj.Name()] = params
+	}
+
+	if st, ok := named.Underlying().(*types.Struct); ok {
+		fields := []*Field{}
+		for i := 0; i < st.NumFields(); i++ {
+			// Embedded fields are left out as in source, the
+			// methods they promote are in the method set.
+			field := st.Field(i)
+			if field.Embedded() || !field.Exported() {
+				continue
+			}
+			fields = append(fields, &Field{
+				Name: field.Name(),
+				Type: types.TypeString(field.Type(), q),
+			})
+		}
+		d.fields[obj.Name()] = fields
+	}
+
+	// The method set includes the promoted methods, so nothing is
+	// recorded as embedded.
+	if methods := typeMethods(pkg+"."+obj.Name(), named, false, q,
+		d.warn); len(methods) > 0 {
+		d.methods[obj.Name()] = methods
+	}
+}
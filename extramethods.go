@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+)
+
+// parseExtraMethod parses sig, the signature of a method to add to an
+// interface, e.g. Close() error, into a method. Its types are written
+// as in the wrapped package.
+func parseExtraMethod(sig string) (*Method, error) {
+	src := "interface{ " + sig + " }"
+	expr, err := parser.ParseExprFrom(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extra method %q: %v", sig, err)
+	}
+	iface, ok := expr.(*ast.InterfaceType)
+	if !ok || len(iface.Methods.List) != 1 {
+		return nil, fmt.Errorf("invalid extra method %q, expected a "+
+			"single method signature, e.g. Close() error", sig)
+	}
+	field := iface.Methods.List[0]
+	fn, ok := field.Type.(*ast.FuncType)
+	if !ok || len(field.Names) != 1 {
+		return nil, fmt.Errorf("invalid extra method %q, expected a "+
+			"single method signature, e.g. Close() error", sig)
+	}
+	if !field.Names[0].IsExported() {
+		return nil, fmt.Errorf("invalid extra method %q: %s isn't "+
+			"exported", sig, field.Names[0].Name)
+	}
+
+	results := []*Field{}
+	if fn.Results != nil {
+		results = getMethodFields([]byte(src), fn.Results.List)
+	}
+	return &Method{
+		Name:    field.Names[0].Name,
+		Params:  nameParams(getMethodFields([]byte(src), fn.Params.List)),
+		Results: results,
+	}, nil
+}
+
+// checkExtraMethods checks that every struct in extra is one of the
+// structs of subpkgs and that their extra methods parse.
+func checkExtraMethods(subpkgs map[string]*Package, extra map[string][]string) error {
+	structs := make(map[string]bool)
+	for _, subpkg := range subpkgs {
+		for _, st := range subpkg.Structs {
+			structs[st.Name] = true
+		}
+	}
+
+	var names []string
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !structs[name] {
+			return fmt.Errorf("can't add methods to %s: there is no "+
+				"such struct", name)
+		}
+		for _, sig := range extra[name] {
+			if _, err := parseExtraMethod(sig); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addExtraMethods adds the methods with the signatures sigs to those of
+// the struct st of the package pkg. all are the struct's methods before
+// any were excluded. An extra method the struct has, but that was
+// excluded, is forwarded to as usual, one it doesn't have is a stub.
+func addExtraMethods(pkg string, st *Struct, all []*Method, sigs []string) error {
+	for _, sig := range sigs {
+		extra, err := parseExtraMethod(sig)
+		if err != nil {
+			return err
+		}
+		for _, method := range st.Methods {
+			if method.Name == extra.Name {
+				return fmt.Errorf("can't add %s.%s.%s: it's already "+
+					"in the interface", pkg, st.Name, extra.Name)
+			}
+		}
+
+		extra.Stub = true
+		for _, method := range all {
+			if method.Name != extra.Name {
+				continue
+			}
+			if have, want := signature(method.Params, method.Results),
+				signature(extra.Params, extra.Results); have != want {
+				return fmt.Errorf("can't add %s.%s.%s%s: it's declared "+
+					"as %s%s", pkg, st.Name, extra.Name, want,
+					extra.Name, have)
+			}
+			extra = method
+		}
+		st.Methods = append(st.Methods, extra)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// genFakesPkg generates the source of the package of fakes for pkg's
+// interfaces, which are in the package <name>iface with the import path
+// ifacePath and are named as opts says.
+// The package's doc comment is opts.PackageDoc, if it's set.
+// Each fake has a <Method>Func field per method that the method calls,
+// if it's set, and a <Method>Calls field counting the method's calls.
+// The fakes are given the methods of mk, if it's set, that they don't
+// have.
+func genFakesPkg(pkg *Package, name, ifacePath string, opts Options, mk *marker) (string, error) {
+	m := newTypeMapper(pkg, name+"iface", ifacePath)
+	m.ifacePrefix = opts.IfaceNamePrefix
+	m.ifaceSuffix = opts.IfaceNameSuffix
+	m.addImport(ifacePath, "")
+
+	var fakes []string
+	for _, st := range pkg.Structs {
+		methods := structMethods(st)
+		fake, err := buildFake(st.Name, st.TypeParams, methods, m)
+		if err != nil {
+			return "", err
+		}
+		fakes = append(fakes, fake)
+		fakes = append(fakes, mk.stubs(st.Name+typeArgList(st.TypeParams),
+			methodNames(methods), m)...)
+	}
+
+	if len(pkg.Functions) > 0 {
+		name := funcsIfaceName(pkg)
+		methods := funcMethods(pkg)
+		fake, err := buildFake(name, nil, methods, m)
+		if err != nil {
+			return "", err
+		}
+		fakes = append(fakes, fake)
+		fakes = append(fakes, mk.stubs(name, methodNames(methods), m)...)
+	}
+
+	fakesTmpl := `// Auto generated code DO NOT EDIT
+
+{{ .Doc }}
+package {{ .Name }}fakes
+{{- with .Imports }}
+
+import (
+{{- range . }}
+    {{ . }}
+{{- end }}
+)
+{{- end }}
+{{- range .Fakes }}
+
+{{ . }}
+{{- end }}
+`
+
+	tmpl, err := template.New("fakes").Parse(fakesTmpl)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, struct {
+		Name    string
+		Doc     string
+		Imports []string
+		Fakes   []string
+	}{
+		Name: name,
+		Doc: packageDoc(name+"fakes", opts.PackageDoc, "contains the generated "+
+			"fakes of the interfaces in "+name+"iface."),
+		Imports: m.Imports(),
+		Fakes:   fakes,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	src, err := formatSource(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return string(src), nil
+}
+
+// buildFake builds a fake implementing the interface name, which is
+// generic if it has typeParams, with the given methods, using m to map
+// their types.
+func buildFake(name string, typeParams []*Field, methods []*Method, m *typeMapper) (string, error) {
+	m.setTypeParams(typeParams)
+	defer m.setTypeParams(nil)
+
+	fake := `// {{ .Name }} is a fake {{ .Iface }}.{{ .IfaceName }}.
+// Its methods count their calls and call the matching function field,
+// if it's set, otherwise they return zero values. It isn't safe for
+// concurrent use.
+type {{ .Name }}{{ .TypeParams }} struct {
+{{- range .Methods }}
+    {{ .Func }} func({{ toList .Params }}){{ with results .Results }} {{ . }}{{ end }}
+    {{ .Calls }} int
+{{- end }}
+}
+
+{{ if .TypeParams -}}
+func _{{ .TypeParams }}() {
+    var _ {{ .Iface }}.{{ .IfaceType }} = (*{{ .Type }})(nil)
+}
+{{- else -}}
+var _ {{ .Iface }}.{{ .IfaceType }} = (*{{ .Type }})(nil)
+{{- end }}
+{{- range $method := .Methods }}
+
+func ({{ $.Recv }} *{{ $.Type }}) {{ .Name }}({{ toList .Params }}){{ with namedResults .Results }} {{ . }}{{ end }} {
+    {{ $.Recv }}.{{ .Calls }}++
+    if {{ $.Recv }}.{{ .Func }} == nil {
+        return
+    }
+    {{ if .Results }}return {{ end }}{{ $.Recv }}.{{ .Func }}({{ args .Params }})
+}
+{{- end }}`
+
+	fakeTmpl, err := template.New("fake").Funcs(template.FuncMap{
+		"toList":  m.fieldList,
+		"results": m.resultList,
+		"namedResults": func(results []*Field) string {
+			return m.resultList(namedResults(results))
+		},
+		"args": callArgs,
+	}).Parse(fake)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	err = fakeTmpl.Execute(buf, struct {
+		Name       string
+		TypeParams string
+		Type       string
+		Iface      string
+		IfaceName  string
+		IfaceType  string
+		Recv       string
+		Methods    []fakeMethod
+	}{
+		Name:       name,
+		TypeParams: m.typeParamList(typeParams),
+		Type:       name + typeArgList(typeParams),
+		Iface:      m.ifaceName,
+		IfaceName:  m.ifaceTypeName(name),
+		IfaceType:  m.ifaceTypeName(name) + typeArgList(typeParams),
+		Recv:       receiverName("f", methods),
+		Methods:    fakeMethods(methods),
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// fakeMethod is a method of a fake with the names of its fields.
+type fakeMethod struct {
+	*Method
+	// Func is the name of the field holding the function the method
+	// calls.
+	Func string
+	// Calls is the name of the field counting the method's calls.
+	Calls string
+}
+
+// fakeMethods names the fields of the fake's methods, <Method>Func and
+// <Method>Calls, with a number appended to those that would collide
+// with one of methods or another field, e.g. DoCalls2 if there's a
+// DoCalls method.
+func fakeMethods(methods []*Method) []fakeMethod {
+	taken := methodNames(methods)
+	name := func(base string) string {
+		name := base
+		for i := 2; taken[name]; i++ {
+			name = base + strconv.Itoa(i)
+		}
+		taken[name] = true
+		return name
+	}
+
+	fakes := make([]fakeMethod, len(methods))
+	for i, method := range methods {
+		fakes[i] = fakeMethod{
+			Method: method,
+			Func:   name(method.Name + "Func"),
+			Calls:  name(method.Name + "Calls"),
+		}
+	}
+	return fakes
+}
+
+// namedResults returns results, naming them r0, r1, ... if they're
+// unnamed so that a bare return returns their zero values.
+func namedResults(results []*Field) []*Field {
+	if len(results) == 0 || results[0].Name != "" {
+		return results
+	}
+	named := make([]*Field, len(results))
+	for i, result := range results {
+		named[i] = &Field{Name: "r" + strconv.Itoa(i), Type: result.Type}
+	}
+	return named
+}
+
+// callArgs renders params as the arguments passing them on, spreading
+// a variadic parameter.
+func callArgs(params []*Field) string {
+	var args []string
+	for _, param := range params {
+		arg := param.Name
+		if strings.HasPrefix(param.Type, "...") {
+			arg += "..."
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, ", ")
+}
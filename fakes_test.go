@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenFakes(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Counter struct{ N int }
+
+func (c *Counter) Add(n int) int { c.N += n; return c.N }
+
+func Double(n int) int { return 2 * n }
+`},
+	})
+
+	opts := testOptions(gopath, "example.com/foo")
+	opts.GenFakes = true
+	files := testGenerate(t, opts)
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	"example.com/out/foofakes"
+	"example.com/out/fooiface"
+)
+
+func main() {
+	fake := &foofakes.Counter{AddFunc: func(n int) int { return 42 }}
+	var c fooiface.Counter = fake
+	fmt.Println(c.Add(1), c.Add(2), fake.AddCalls, c.N(), fake.NCalls)
+
+	var funcs fooiface.FooFuncs = &foofakes.FooFuncs{}
+	fmt.Println(funcs.Double(2))
+}
+`)
+	if want := "42 42 2 0 1\n0\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestGenFakesFieldCollisions(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type S struct{}
+
+func (s *S) Do()            {}
+func (s *S) DoCalls() int   { return 0 }
+func (s *S) DoFunc()        {}
+func (s *S) DoFuncFunc()    {}
+`},
+	})
+
+	opts := testOptions(gopath, "example.com/foo")
+	opts.GenFakes = true
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+
+	fakes := files["example.com/out/foofakes/foofakes.go"]
+	for _, want := range []string{
+		"DoFunc2 ", "DoCalls2 ", "DoCallsFunc ", "DoFuncFunc2 ",
+		"DoFuncFuncFunc ",
+	} {
+		if !strings.Contains(fakes, "\t"+want) {
+			t.Errorf("the fake has no field %s:\n%s", want, fakes)
+		}
+	}
+}
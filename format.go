@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// formatWith returns a PostProcess function piping each generated file
+// through the formatter command, e.g. gofumpt or goimports, which must
+// read the source from stdin and write the formatted source to stdout.
+// If the command can't be found, it's nil and the files are left as
+// gofmt formats them, with a warning.
+func formatWith(command string) func(GeneratedFile) (GeneratedFile, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+	tool, err := exec.LookPath(args[0])
+	if err != nil {
+		log.Printf("warning: formatter %s not found, using gofmt: %v",
+			args[0], err)
+		return nil
+	}
+
+	return func(file GeneratedFile) (GeneratedFile, error) {
+		cmd := exec.Command(tool, args[1:]...)
+		cmd.Stdin = bytes.NewReader(file.Source)
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		if err := cmd.Run(); err != nil {
+			return file, fmt.Errorf("formatting with %s: %v: %s", command,
+				err, strings.TrimSpace(stderr.String()))
+		}
+		file.Source = stdout.Bytes()
+		return file, nil
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// marker is the interface embedded in every generated interface, given
+// by Options.MarkerInterface.
+type marker struct {
+	// importPath is the import path of the marker's package.
+	importPath string
+	// pkgName is the name of the marker's package.
+	pkgName string
+	// name is the marker's name qualified by its package's name, e.g.
+	// io.Closer.
+	name string
+	// methods are the marker's methods. The wrappers and fakes are
+	// given those they don't already have, doing nothing, so that they
+	// implement it.
+	methods []*types.Func
+}
+
+// loadMarker loads the marker interface spec, given as
+// <import path>.<Name>, from its package's source. It's an error if
+// it's not an interface the generated code can implement, one with
+// methods, all of them exported and using only exported types. An
+// interface without methods is rejected too, as every value would
+// implement it.
+func loadMarker(spec string) (*marker, error) {
+	importPath, name, err := parseMarker(spec)
+	if err != nil {
+		return nil, usageError{err}
+	}
+	pkg, err := importer.ForCompiler(token.NewFileSet(), "source",
+		nil).Import(importPath)
+	if err != nil {
+		return nil, parseError{fmt.Errorf("loading the marker "+
+			"interface %s: %v", spec, err)}
+	}
+
+	mk := &marker{
+		importPath: importPath,
+		pkgName:    pkg.Name(),
+		name:       pkg.Name() + "." + name,
+	}
+	tn, ok := pkg.Scope().Lookup(name).(*types.TypeName)
+	if !ok {
+		return nil, usageError{fmt.Errorf("invalid marker interface "+
+			"%s: %s declares no type %s", spec, importPath, name)}
+	}
+	iface, ok := tn.Type().Underlying().(*types.Interface)
+	if named, isNamed := tn.Type().(*types.Named); !ok ||
+		!iface.IsMethodSet() || isNamed && named.TypeParams().Len() > 0 {
+		return nil, usageError{fmt.Errorf("invalid marker interface "+
+			"%s: it isn't a non-generic interface", spec)}
+	}
+	if iface.NumMethods() == 0 {
+		return nil, usageError{fmt.Errorf("invalid marker interface "+
+			"%s: it has no methods, so every value implements it", spec)}
+	}
+
+	q := func(p *types.Package) string { return p.Name() }
+	for i := 0; i < iface.NumMethods(); i++ {
+		fn := iface.Method(i)
+		if !fn.Exported() {
+			return nil, usageError{fmt.Errorf("invalid marker "+
+				"interface %s: its method %s isn't exported, so it "+
+				"can't be implemented outside %s", spec, fn.Name(),
+				importPath)}
+		}
+		sig := fn.Type().(*types.Signature)
+		if typ := signatureForeignUnexported(&Method{
+			Params:  tupleFields(sig.Params(), sig.Variadic(), q),
+			Results: tupleFields(sig.Results(), false, q),
+		}); typ != "" {
+			return nil, usageError{fmt.Errorf("invalid marker "+
+				"interface %s: its method %s uses the unexported type "+
+				"%s", spec, fn.Name(), typ)}
+		}
+		mk.methods = append(mk.methods, fn)
+	}
+	return mk, nil
+}
+
+// parseMarker splits a marker interface given as <import path>.<Name>
+// into the import path and the name.
+func parseMarker(marker string) (string, string, error) {
+	i := strings.LastIndex(marker, ".")
+	if i <= strings.LastIndex(marker, "/") || !ast.IsExported(marker[i+1:]) {
+		return "", "", fmt.Errorf("invalid marker interface %q, "+
+			"expected <import path>.<Name>", marker)
+	}
+	return marker[:i], marker[i+1:], nil
+}
+
+// String returns the marker's name, qualified by its package's name.
+// It's "" if mk is nil.
+func (mk *marker) String() string {
+	if mk == nil {
+		return ""
+	}
+	return mk.name
+}
+
+// fields returns the params and results of the marker's method fn, with
+// their types named as in the package m maps types for, and adds the
+// imports they need to m.
+func (mk *marker) fields(fn *types.Func, m *typeMapper) ([]*Field, []*Field) {
+	q := func(p *types.Package) string {
+		if p.Path() == m.pkg.ImportPath {
+			m.addImport(p.Path(), m.pkgName)
+			return m.pkgName
+		}
+		m.addImport(p.Path(), p.Name())
+		return p.Name()
+	}
+	sig := fn.Type().(*types.Signature)
+	return tupleFields(sig.Params(), sig.Variadic(), q),
+		tupleFields(sig.Results(), false, q)
+}
+
+// check checks that the methods of the interface iface, as generated
+// with m, that the marker also has have the same signatures, as they
+// couldn't both be in the interface otherwise. It's nil if mk is.
+func (mk *marker) check(iface string, methods []*Method, m *typeMapper) error {
+	if mk == nil {
+		return nil
+	}
+	mapped := func(fields []*Field) []*Field {
+		mapped := make([]*Field, len(fields))
+		for i, field := range fields {
+			mapped[i] = &Field{Type: m.ifaceType(field.Type)}
+		}
+		return mapped
+	}
+	for _, fn := range mk.methods {
+		for _, method := range methods {
+			if method.Name != fn.Name() {
+				continue
+			}
+			params, results := mk.fields(fn, m)
+			have := signature(mapped(method.Params), mapped(method.Results))
+			if want := signature(params, results); have != want {
+				return fmt.Errorf("can't embed the marker interface %s "+
+					"in %s: it has the method %s%s but the marker has "+
+					"%s%s", mk.name, iface, fn.Name(), have, fn.Name(),
+					want)
+			}
+		}
+	}
+	return nil
+}
+
+// stubs returns a method of typ doing nothing but returning zero
+// values for each of the marker's methods that aren't in have, so that
+// typ implements the marker. They're generated in the package m maps
+// types for. It's nil if mk is.
+func (mk *marker) stubs(typ string, have map[string]bool, m *typeMapper) []string {
+	if mk == nil {
+		return nil
+	}
+	list := func(fields []*Field) string {
+		var list []string
+		for _, field := range fields {
+			list = append(list, strings.TrimSpace(field.Name+" "+
+				field.Type))
+		}
+		return strings.Join(list, ", ")
+	}
+
+	var stubs []string
+	for _, fn := range mk.methods {
+		if have[fn.Name()] {
+			continue
+		}
+		params, results := mk.fields(fn, m)
+		stub := fmt.Sprintf("// %s is a method of the marker interface "+
+			"%s, it does nothing.\nfunc (%s) %s(%s)", fn.Name(), mk.name,
+			typ, fn.Name(), list(params))
+		if len(results) > 0 {
+			stub += " (" + list(namedResults(results)) + ") {\n" +
+				"    return\n}"
+		} else {
+			stub += " {}"
+		}
+		stubs = append(stubs, stub)
+	}
+	return stubs
+}
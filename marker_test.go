@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkerInterface(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/mk": {"mk.go": `package mk
+
+import "io"
+
+type Wrapped interface {
+	TestableWrapper(r io.Reader, opts ...string) (string, error)
+	io.Closer
+}
+`},
+		"example.com/foo": {"foo.go": `package foo
+
+type File struct{}
+
+func (f *File) Close() error { return nil }
+
+type Conn struct{ Addr string }
+
+func Dial(addr string) *Conn { return nil }
+`},
+	})
+
+	opts := testOptions(gopath, "example.com/foo")
+	opts.MarkerInterface = "example.com/mk.Wrapped"
+	opts.GenFakes = true
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+
+	testContains(t, fooIface, files[fooIface], "\t\"example.com/mk\"\n",
+		"type File interface {\n\tmk.Wrapped\n",
+		"type FooFuncs interface {\n\tmk.Wrapped\n")
+
+	impl := files["example.com/out/foo/foo.go"]
+	for _, want := range []string{
+		"func (Conn) Close() (r0 error) {",
+		"func (File) TestableWrapper(r io.Reader, opts ...string) (r0 string, r1 error) {",
+		"func (fooFuncs) Close() (r0 error) {",
+	} {
+		if !strings.Contains(impl, want) {
+			t.Errorf("the wrappers don't have %s:\n%s", want, impl)
+		}
+	}
+	// File's own Close is forwarded to rather than stubbed.
+	if strings.Contains(impl, "func (File) Close()") {
+		t.Errorf("File's Close is stubbed:\n%s", impl)
+	}
+	if fakes := files["example.com/out/foofakes/foofakes.go"]; !strings.Contains(fakes,
+		"func (Conn) TestableWrapper(") {
+		t.Errorf("the fakes don't implement the marker:\n%s", fakes)
+	}
+}
+
+func TestMarkerInterfaceInvalid(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/mk": {"mk.go": `package mk
+
+type Empty interface{}
+
+type Hidden interface{ hidden() }
+
+type Unexported interface{ Mark() secret }
+
+type secret int
+
+type Closer interface{ Close() error }
+
+type NotIface struct{}
+`},
+		"example.com/foo": {"foo.go": `package foo
+
+type Counter struct{}
+
+func (c *Counter) Close() int { return 0 }
+`},
+	})
+
+	for marker, want := range map[string]string{
+		"example.com/mk":            "expected <import path>.<Name>",
+		"example.com/mk.Empty":      "it has no methods",
+		"example.com/mk.Hidden":     "its method hidden isn't exported",
+		"example.com/mk.Unexported": "uses the unexported type mk.secret",
+		"example.com/mk.NotIface":   "isn't a non-generic interface",
+		"example.com/mk.Missing":    "declares no type Missing",
+		"example.com/mk.Closer": "it has the method Close() int but the " +
+			"marker has Close() error",
+	} {
+		opts := testOptions(gopath, "example.com/foo")
+		opts.MarkerInterface = marker
+		_, err := Generate(opts)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("marker %s: got error %v, want one containing %q",
+				marker, err, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PackageReport summarises what was wrapped of one of the input's
+// packages and what was skipped.
+type PackageReport struct {
+	// Package is the name of the wrapped package.
+	Package string `json:"package"`
+	// Structs are the wrapped structs.
+	Structs []string `json:"structs"`
+	// Functions are the wrapped functions.
+	Functions []string `json:"functions"`
+	// Skipped are the members that couldn't be wrapped.
+	Skipped []SkippedMember `json:"skipped"`
+	// Warnings are the other warnings given about the package, such as
+	// an accessor being renamed.
+	Warnings []string `json:"warnings"`
+}
+
+// SkippedMember is a member of the input package that wasn't wrapped.
+type SkippedMember struct {
+	// Member is the skipped member, e.g. pkg.List or pkg.Client.Do.
+	Member string `json:"member"`
+	// Reason says why it was skipped.
+	Reason string `json:"reason"`
+}
+
+func newPackageReport(pkg string) *PackageReport {
+	return &PackageReport{
+		Package:   pkg,
+		Structs:   []string{},
+		Functions: []string{},
+		Skipped:   []SkippedMember{},
+		Warnings:  []string{},
+	}
+}
+
+// warn records the warning err, as a skipped member if it says a member
+// was skipped.
+func (r *PackageReport) warn(err error) {
+	var (
+		unsupported *UnsupportedTypeError
+		unexported  *UnexportedDependencyError
+		internal    *InternalImportError
+	)
+	switch {
+	case errors.As(err, &internal):
+		// Nothing's skipped, the generated package just can't be
+		// compiled where it's put.
+	case errors.As(err, &unsupported):
+		r.Skipped = append(r.Skipped, SkippedMember{
+			Member: unsupported.Member,
+			Reason: unsupported.Reason,
+		})
+	case errors.As(err, &unexported):
+		r.Skipped = append(r.Skipped, SkippedMember{
+			Member: unexported.Member,
+			Reason: fmt.Sprintf("it uses the unexported type %s",
+				unexported.Type),
+		})
+	default:
+		r.Warnings = append(r.Warnings, err.Error())
+	}
+}
+
+// wrapped records the structs and functions of pkg, once it's been
+// generated, as wrapped.
+func (r *PackageReport) wrapped(pkg *Package) {
+	for _, st := range pkg.Structs {
+		r.Structs = append(r.Structs, st.Name)
+	}
+	for _, fn := range pkg.Functions {
+		r.Functions = append(r.Functions, fn.Name)
+	}
+}
@@ -2,29 +2,49 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
 	"go/format"
+	"go/importer"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"io/ioutil"
 	l "log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/vburenin/ifacemaker/maker"
 )
 
 var log = l.New(os.Stderr, "", l.Lshortfile)
 
+// formatSource formats the generated packages. Tests replace it to see
+// the templates' output as it is.
+var formatSource = format.Source
+
+// parseFile parses the input package's files. Benchmarks replace it to
+// count the parses.
+var parseFile = parser.ParseFile
+
 // Field ...
 type Field struct {
 	Name string
 	Type string
+	// Getter is the name of the accessor generated for a struct
+	// field.
+	Getter string
 }
 
 // Method ...
@@ -32,6 +52,14 @@ type Method struct {
 	Name    string
 	Params  []*Field
 	Results []*Field
+	// ValueRecv is set if the method has a value receiver.
+	ValueRecv bool
+	// RecvTypeParams are the names a generic receiver gives its type's
+	// type parameters, e.g. E for (s *Stack[E]).
+	RecvTypeParams []string
+	// Stub is set for a method added to the interface that the wrapped
+	// struct doesn't have, so its wrapper has nothing to forward to.
+	Stub bool
 }
 
 // Struct ...
@@ -40,6 +68,15 @@ type Struct struct {
 	Methods []*Method
 	Fields  []*Field
 	Parent  *ast.StructType
+	// Doc is the text of the struct's doc comment.
+	Doc string
+	// TypeParams are the type parameters of a generic struct, with
+	// their constraints as their types.
+	TypeParams []*Field
+	// Embeds are the types embedded in the struct. Local types are
+	// given by name and foreign types as they're written, e.g.
+	// *bytes.Buffer.
+	Embeds []string
 }
 
 // Function ...
@@ -55,476 +92,2731 @@ type Package struct {
 	Name       string
 	Structs    []*Struct
 	Functions  []*Function
+	TypeNames  []string
 	ImportPath string
+	// Imports maps the names the package's files refer to other
+	// packages by to their import paths.
+	Imports map[string]string
+	// Warnings are the members skipped while loading the package.
+	Warnings []error
+	// Deprecated are the package's members whose doc comments say
+	// they're deprecated, as <Struct>, <Struct>.<Member> or <Func>.
+	Deprecated map[string]bool
+}
+
+// GeneratedFile is a single file produced by Generate.
+type GeneratedFile struct {
+	// Path is where the file should be written.
+	Path string
+	// Source is the formatted Go source of the file.
+	Source []byte
+}
+
+// Options configures Generate.
+type Options struct {
+	// Input is the import path of the package to make testable.
+	Input string
+	// Output is the directory the generated packages are put in.
+	Output string
+	// BasePkg is the import path of Output.
+	BasePkg string
+	// IfaceOutput and IfaceBasePkg, if set, override Output and
+	// BasePkg for the interface packages.
+	IfaceOutput  string
+	IfaceBasePkg string
+	// ImplOutput and ImplBasePkg, if set, override Output and BasePkg
+	// for the implementation packages.
+	ImplOutput  string
+	ImplBasePkg string
+	// GetterPrefix is prepended to the name of each field accessor.
+	GetterPrefix string
+	// IfaceNamePrefix and IfaceNameSuffix are added to the names of
+	// the generated interfaces, e.g. a suffix of Interface names the
+	// interface of Foo FooInterface. The prefix must start with an
+	// upper case letter.
+	IfaceNamePrefix string
+	IfaceNameSuffix string
+	// NoFieldAccessors leaves out the accessors of exported fields, so
+	// that only methods are wrapped.
+	NoFieldAccessors bool
+	// ParentField is the name of the field holding the wrapped struct
+	// in each wrapper. It defaults to parent.
+	ParentField string
+	// MarkerInterface, if set, is an interface given as
+	// <import path>.<Name> that is embedded in every generated
+	// interface. The wrappers and fakes are given the methods of it
+	// they don't have, which do nothing, so that they implement it. It
+	// must have methods, all of them exported.
+	MarkerInterface string
+	// ProvenanceComments comments each interface method with the
+	// member of the wrapped package it forwards to.
+	ProvenanceComments bool
+	// ExcludeMethods are patterns of methods to leave out of the
+	// generated code, either <Method> for the method of every struct
+	// or <Struct>.<Method>.
+	ExcludeMethods []string
+	// ExtraMethods maps the names of structs to the signatures of
+	// methods to add to their interfaces, e.g. Client to Close() error,
+	// with their types written as in the wrapped package. A method the
+	// struct has, but that's excluded, is forwarded to. The wrappers
+	// of methods it doesn't have panic.
+	ExtraMethods map[string][]string
+	// NoHeader leaves the DO NOT EDIT header out of the generated
+	// files.
+	NoHeader bool
+	// NoPackage leaves the package clause and its doc comment out of
+	// the generated files, so that their declarations can be spliced
+	// into another file. They can't be compiled on their own then.
+	NoPackage bool
+	// SkipDeprecated leaves out the structs, fields, methods and
+	// functions whose doc comments have a Deprecated: paragraph.
+	SkipDeprecated bool
+	// MaxMethods, if not 0, skips structs with more methods than it.
+	MaxMethods int
+	// ContinueOnError carries on generating the other packages when
+	// one of them fails. The errors are joined together and returned
+	// along with the files that could be generated.
+	ContinueOnError bool
+	// GenFakes also generates a <pkg>fakes package with a fake of
+	// each interface, which can be stubbed out function by function.
+	GenFakes bool
+	// PackageDoc, if set, is the doc comment of the generated packages,
+	// following "Package <name> ".
+	PackageDoc string
+	// MirrorReceivers gives the wrappers' methods the same kind of
+	// receivers as the methods they forward to, rather than always
+	// pointer receivers, so that wrappers' values have methods too.
+	MirrorReceivers bool
+	// SafeForward makes the wrappers' methods panic with a message
+	// naming the method, rather than dereferencing nil, when the
+	// wrapper has no parent, e.g. because it's a zero value.
+	SafeForward bool
+	// StripPrefix is trimmed from the wrapped package's name to give
+	// the names of the generated packages, e.g. internal turns
+	// internalfoo into foo and fooiface.
+	StripPrefix string
+	// Groups maps the names of structs to the names of the packages
+	// they're generated in, instead of the packages named after the
+	// wrapped package, e.g. User to auth for authiface and auth.
+	Groups map[string]string
+	// Order is the order of the generated methods: "source", the
+	// default, keeps the order they're declared in, and "name" sorts
+	// them by name.
+	Order string
+	// IfacesOnly skips generating the implementation packages.
+	IfacesOnly bool
+	// BuildTag, if set, is a build tag the generated files are
+	// constrained to.
+	BuildTag string
+	// ExportData reads the input package's export data instead of
+	// parsing its source, so that packages without source can be
+	// wrapped. Overlay is ignored.
+	ExportData bool
+	// Overlay maps file names to contents that are used in place of
+	// the contents of the files on disk, e.g. for unsaved editor
+	// buffers.
+	Overlay map[string][]byte
+	// Warn, if set, is called with each member of the input package
+	// that's skipped, as an *UnsupportedTypeError or an
+	// *UnexportedDependencyError, instead of it being logged. It's also
+	// called with an *InternalImportError for each internal package a
+	// generated package imports but isn't allowed to.
+	Warn func(error)
+	// Report, if set, is called with a report of each of the input's
+	// packages that's generated, saying what was wrapped and skipped.
+	Report func(PackageReport)
+	// PostProcess, if set, is called with each generated file and
+	// its result is used in place of the file. An error aborts
+	// generation.
+	PostProcess func(GeneratedFile) (GeneratedFile, error)
 }
 
 func main() {
-	out := flag.String("output", "", "Output dir")
-	in := flag.String("input", "", "Package to make testable")
-	flag.Parse()
+	cmd, args, err := parseCommand(os.Args[1:])
+	if err != nil {
+		exit(err)
+	}
 
-	if in == nil || *in == "" {
-		fmt.Fprintln(os.Stderr, "Require a package name")
-		flag.PrintDefaults()
-		os.Exit(1)
+	// Bad flags are usage errors like any other, rather than exiting
+	// with the flag package's code.
+	fs := flag.NewFlagSet(strings.TrimSpace(os.Args[0]+" "+cmd.name),
+		flag.ContinueOnError)
+	f, modeFlags := addCommandFlags(cmd, fs)
+	fs.Usage = commandUsage(cmd, fs)
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(exitUsage)
 	}
 
-	absOut, err := filepath.Abs(*out)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error())
-		os.Exit(1)
+	if err := applyConfig(fs, *f.config); err != nil {
+		exit(usageError{err})
 	}
-	out = &absOut
 
-	basePkg := strings.TrimPrefix(*out, path.Join(os.Getenv("GOPATH"), "src")+"/")
+	if *f.quiet {
+		log.SetOutput(ioutil.Discard)
+	}
 
-	ifacePkgs, implPkgs, err := genCode(*in, basePkg)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error())
-		os.Exit(1)
+	if cmd.name == "" {
+		log.Printf("warning: flags without a command are deprecated, "+
+			"use %s gen, list, diff, check or report", os.Args[0])
 	}
 
-	for pkgName, pkg := range ifacePkgs {
-		pkgPath := path.Join(*out, pkgName)
-		err := os.MkdirAll(pkgPath, os.ModePerm)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, err.Error())
-			os.Exit(1)
-		}
+	if *f.in == "" {
+		fmt.Fprintln(os.Stderr, "Require a package name")
+		fs.PrintDefaults()
+		os.Exit(exitUsage)
+	}
 
-		pkgFile := path.Join(pkgPath, pkgName+".go")
-		err = ioutil.WriteFile(pkgFile, []byte(pkg), os.ModePerm)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, err.Error())
-			os.Exit(1)
-		}
+	opts, err := f.options()
+	if err != nil {
+		exit(err)
 	}
 
-	for pkgName, pkg := range implPkgs {
-		pkgPath := path.Join(*out, pkgName)
-		err := os.MkdirAll(pkgPath, os.ModePerm)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, err.Error())
-			os.Exit(1)
+	mode := cmd.mode
+	modes := 0
+	for _, m := range []struct {
+		flag string
+		mode outputMode
+	}{
+		{"stdout", printFiles},
+		{"diff", diffFiles},
+		{"check", checkFiles},
+		{"report", reportPackages},
+	} {
+		if set := modeFlags[m.flag]; set != nil && *set {
+			mode = m.mode
+			modes++
 		}
+	}
+	if modes > 1 {
+		exit(usageError{errors.New("only one of -stdout, -diff, " +
+			"-check and -report can be used")})
+	}
 
-		pkgFile := path.Join(pkgPath, pkgName+".go")
-		err = ioutil.WriteFile(pkgFile, []byte(pkg), os.ModePerm)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, err.Error())
-			os.Exit(1)
-		}
+	if watch := modeFlags["watch"]; watch != nil && *watch {
+		watchInput(opts, *f.timeout, mode)
+		return
 	}
-}
 
-func genCode(pkgPath string, basePkg string) (map[string]string, map[string]string, error) {
-	subpkgs, err := getSubpackages(pkgPath)
-	if err != nil {
-		return nil, nil, err
+	if err := run(opts, *f.timeout, mode); err != nil {
+		exit(err)
 	}
+}
 
-	ifaceTmpl := `
-// Auto generated code DO NOT EDIT
-package {{.Name}}iface
+// The exit codes for each category of error.
+const (
+	exitUsage    = 1
+	exitParse    = 2
+	exitGenerate = 3
+	exitWrite    = 4
+	exitStale    = 5
+)
 
-{{ range $iface := .Interfaces }}
-{{ $iface }}
-{{ end }}
-`
+// errStale is returned when the generated files differ from those on
+// disk and they are only compared, not written.
+var errStale = errors.New("the generated files are out of date")
 
-	implTmpl := `
-// Auto generated code DO NOT EDIT
-package {{.Name}}
+// usageError is an error caused by invalid flags or options.
+type usageError struct{ err error }
 
-import "{{ .ImportPath }}"
-import "{{ .BasePkg }}/{{.Name}}iface"
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
 
-{{ range $impl := .Implementations }}
-{{ $impl }}
-{{ end }}
+// parseError is an error reading or parsing the input package.
+type parseError struct{ err error }
 
-{{ range $func := .Funcs }}
-{{ $func }}
-{{ end }}
-`
-	ifacePkgsMap := make(map[string]string)
-	implPkgsMap := make(map[string]string)
-	for subpkgName, subpkg := range subpkgs {
-		ifaces, err := buildIfaces(subpkg)
-		if err != nil {
-			return nil, nil, err
-		}
+func (e parseError) Error() string { return e.err.Error() }
+func (e parseError) Unwrap() error { return e.err }
 
-		ifacePkgBuf := new(bytes.Buffer)
+// writeError is an error writing the generated files.
+type writeError struct{ err error }
 
-		tmpl, err := template.New("iface").Parse(ifaceTmpl)
-		if err != nil {
-			return nil, nil, err
+func (e writeError) Error() string { return e.err.Error() }
+func (e writeError) Unwrap() error { return e.err }
+
+// exit prints err and exits with the code for its category.
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(exitCode(err))
+}
+
+// exitCode returns the code for err's category. Errors that aren't
+// categorised are generation errors.
+func exitCode(err error) int {
+	var (
+		usageErr usageError
+		parseErr parseError
+		writeErr writeError
+	)
+	switch {
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.As(err, &parseErr):
+		return exitParse
+	case errors.As(err, &writeErr):
+		return exitWrite
+	case errors.Is(err, errStale):
+		return exitStale
+	}
+	return exitGenerate
+}
+
+// outputMode is what run does with the generated files.
+type outputMode int
+
+const (
+	// writeFiles writes the files to disk.
+	writeFiles outputMode = iota
+	// printFiles writes the files to stdout.
+	printFiles
+	// diffFiles prints a diff of each file against the file on disk,
+	// writing nothing.
+	diffFiles
+	// checkFiles lists the files whose contents differ from the files
+	// on disk, other than in formatting, writing nothing.
+	checkFiles
+	// listFiles lists the paths of the files, writing nothing.
+	listFiles
+	// reportPackages prints a JSON report of what was wrapped of each
+	// package and what was skipped, writing nothing.
+	reportPackages
+)
+
+// run generates the packages described by opts and does what mode says
+// with them. A non-zero timeout bounds generation.
+func run(opts Options, timeout time.Duration, mode outputMode) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var reports []PackageReport
+	if mode == reportPackages {
+		opts.Report = func(report PackageReport) {
+			reports = append(reports, report)
 		}
+	}
 
-		err = tmpl.Execute(ifacePkgBuf, struct {
-			Name       string
-			Interfaces []string
-		}{
-			Name:       subpkgName,
-			Interfaces: ifaces,
-		})
+	// GenerateContext only checks ctx between files and packages, so a
+	// file that's slow to parse or a package that's slow to load would
+	// overrun the timeout. It's run on a goroutine so that the timeout
+	// holds anyway. Nothing has been written when it runs out, and the
+	// goroutine goes when testable exits right after.
+	type result struct {
+		files []GeneratedFile
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		files, err := GenerateContext(ctx, opts)
+		done <- result{files, err}
+	}()
+	var files []GeneratedFile
+	var err error
+	select {
+	case r := <-done:
+		files, err = r.files, r.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("generation timed out after %s", timeout)
+	}
+	// With ContinueOnError, the packages that could be generated are
+	// still written before the error is reported.
+	if err != nil && !opts.ContinueOnError {
+		return err
+	}
 
-		ifacePkg, err := format.Source(ifacePkgBuf.Bytes())
-		if err != nil {
-			return nil, nil, err
+	switch mode {
+	case reportPackages:
+		data, jsonErr := json.MarshalIndent(reports, "", "    ")
+		if jsonErr != nil {
+			return jsonErr
+		}
+		fmt.Printf("%s\n", data)
+		return err
+	case listFiles:
+		for _, file := range files {
+			fmt.Println(file.Path)
 		}
+		return err
+	case printFiles:
+		for _, file := range files {
+			fmt.Printf("// FILE: %s\n%s", file.Path, file.Source)
+		}
+		return err
+	case diffFiles, checkFiles:
+		stale, diffErr := compareGenerated(files, mode)
+		if diffErr != nil {
+			return diffErr
+		}
+		if err == nil && stale {
+			err = errStale
+		}
+		return err
+	}
 
-		impls, err := buildImpls(subpkg)
-		if err != nil {
-			return nil, nil, err
+	for _, file := range files {
+		if err := os.MkdirAll(path.Dir(file.Path), os.ModePerm); err != nil {
+			return writeError{err}
 		}
 
-		funcs, err := buildFuncs(subpkg)
-		if err != nil {
-			return nil, nil, err
+		if err := writeFileAtomic(file.Path, file.Source); err != nil {
+			return writeError{err}
 		}
+	}
+	return err
+}
 
-		implPkgBuf := new(bytes.Buffer)
-		tmpl, err = template.New("impl").Parse(implTmpl)
-		if err != nil {
-			return nil, nil, err
+// compareGenerated compares each of files against the file on disk,
+// reporting whether any of them differ. For diffFiles, a unified diff of
+// each file that differs is printed, with files that don't exist yet
+// diffed against an empty file. For checkFiles, the files on disk are
+// formatted before they're compared, so that only changes to their
+// contents count, and the path of each file that differs is printed.
+func compareGenerated(files []GeneratedFile, mode outputMode) (bool, error) {
+	stale := false
+	for _, file := range files {
+		old, err := ioutil.ReadFile(file.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
 		}
 
-		err = tmpl.Execute(implPkgBuf, struct {
-			Name            string
-			Implementations []string
-			Funcs           []string
-			ImportPath      string
-			BasePkg         string
-		}{
-			Name:            subpkgName,
-			Implementations: impls,
-			Funcs:           funcs,
-			ImportPath:      subpkg.ImportPath,
-			BasePkg:         basePkg,
-		})
-		if err != nil {
-			return nil, nil, err
+		if mode == checkFiles {
+			// A file that doesn't parse is stale anyway.
+			if formatted, err := format.Source(old); err == nil {
+				old = formatted
+			}
+			if old == nil || !bytes.Equal(old, file.Source) {
+				fmt.Println(file.Path)
+				stale = true
+			}
+			continue
 		}
 
-		implPkg, err := format.Source(implPkgBuf.Bytes())
-		if err != nil {
-			return nil, nil, err
+		oldName := file.Path
+		if old == nil {
+			oldName = os.DevNull
+		}
+		if diff := unifiedDiff(oldName, file.Path, old,
+			file.Source); diff != "" {
+			fmt.Print(diff)
+			stale = true
 		}
+	}
+	return stale, nil
+}
 
-		ifacePkgsMap[subpkgName+"iface"] = string(ifacePkg)
-		implPkgsMap[subpkgName] = string(implPkg)
+// writeFileAtomic writes data to filename such that readers only ever
+// see the old or the new contents of the file. The data is written to
+// a temporary file which is then renamed over filename.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename))
+	if err != nil {
+		return err
 	}
+	defer os.Remove(tmp.Name())
 
-	return ifacePkgsMap, implPkgsMap, nil
-}
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
 
-func parsePkg(pkg string) (map[string]*ast.Package, error) {
-	pkg = path.Join(os.Getenv("GOPATH"), "src", pkg)
-	return parser.ParseDir(token.NewFileSet(), pkg, func(info os.FileInfo) bool {
-		return !strings.Contains(info.Name(), "test")
-	}, parser.DeclarationErrors)
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
 
+	return os.Rename(tmp.Name(), filename)
 }
 
-func buildFuncs(pkg *Package) ([]string, error) {
-	fn := `
-func {{ .Name }}({{ toList .Params }}) ({{ toList .Results }}) {
-    return {{ .PkgName }}.{{ .Name }}({{ toArgs .Params }})
-}
-`
-	fnTmpl, err := template.New("fn").Funcs(template.FuncMap{
-		"toList": func(fields []*Field) string {
-			var list string
-			prefix := ""
-			for _, field := range fields {
-				typ := maybeAddIfacePkg(pkg, field.Type)
-				list += prefix + field.Name + " " + typ
-				prefix = ", "
-			}
-			return list
-		},
-		"returnsError": func(fields []*Field) bool {
-			for _, field := range fields {
-				if field.Type == "error" {
-					return true
-				}
-			}
-			return false
-		},
-		"toArgs": func(fields []*Field) string {
-			var args string
-			prefix := ""
-			for _, field := range fields {
-				args += prefix + field.Name
-				prefix = ", "
-			}
-			return args
-		},
-	}).Parse(fn)
+// resolveOutput returns the absolute path of the output directory dir
+// and its import path.
+func resolveOutput(dir string) (string, string, error) {
+	absDir, err := filepath.Abs(dir)
 	if err != nil {
-		return []string{}, err
+		return "", "", err
 	}
-
-	var funcs []string
-	for _, fn := range pkg.Functions {
-		buf := new(bytes.Buffer)
-		err := fnTmpl.Execute(buf, struct {
-			PkgName string
-			Name    string
-			Params  []*Field
-			Results []*Field
-		}{
-			PkgName: pkg.Name,
-			Name:    fn.Name,
-			Params:  fn.Params,
-			Results: fn.Results,
-		})
-		if err != nil {
-			return []string{}, err
+	for _, gopath := range gopaths() {
+		src := path.Join(gopath, "src") + "/"
+		if strings.HasPrefix(absDir, src) {
+			return absDir, strings.TrimPrefix(absDir, src), nil
 		}
-
-		funcs = append(funcs, buf.String())
 	}
+	return absDir, absDir, nil
+}
 
-	return funcs, nil
+// gopaths returns the entries of GOPATH, which may list several
+// workspaces.
+func gopaths() []string {
+	return filepath.SplitList(os.Getenv("GOPATH"))
 }
 
-func getSubpackages(pkg string) (map[string]*Package, error) {
-	subpkgs, err := parsePkg(pkg)
-	if err != nil {
-		return nil, err
+// pkgDir returns the directory of the package with the import path pkg,
+// in the first GOPATH entry that has it. If none does, it's the
+// directory the package would have in the first entry.
+func pkgDir(pkg string) string {
+	gopaths := gopaths()
+	if len(gopaths) == 0 {
+		return path.Join("src", pkg)
 	}
-
-	subpkgMap := make(map[string]*Package)
-	for subpkgName, subpkg := range subpkgs {
-		structs, err := getStructs(subpkg)
-		if err != nil {
-			return nil, err
-		}
-		funcs, err := getFunctions(subpkg)
-		if err != nil {
-			return nil, err
-		}
-		subpkgMap[subpkgName] = &Package{
-			ImportPath: pkg,
-			Name:       subpkgName,
-			Structs:    structs,
-			Functions:  funcs,
+	for _, gopath := range gopaths {
+		dir := path.Join(gopath, "src", pkg)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
 		}
 	}
+	return path.Join(gopaths[0], "src", pkg)
+}
 
-	return subpkgMap, nil
+// Generate generates the interface and implementation packages for
+// opts.Input. Nothing is written to disk, the caller is responsible
+// for writing the returned files.
+func Generate(opts Options) ([]GeneratedFile, error) {
+	return GenerateContext(context.Background(), opts)
 }
 
-func getFunctions(pkg *ast.Package) ([]*Function, error) {
-	var funcs []*Function
+// GenerateContext is like Generate but gives up, returning ctx.Err(),
+// once ctx is done. ctx is checked before each file is parsed and each
+// package and group is generated, so a single file that's slow to parse
+// or package that's slow to load still holds it up, but nothing is left
+// running once it returns. No files are ever returned from a cancelled
+// run.
+func GenerateContext(ctx context.Context, opts Options) ([]GeneratedFile, error) {
+	files, err := generate(ctx, opts, func() (map[string]*Package, error) {
+		if opts.ExportData {
+			return loadExportData(opts.Input)
+		}
+		return getSubpackages(ctx, opts.Input, opts.Overlay)
+	})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return files, err
+}
 
-	for astFileName, astFile := range pkg.Files {
-		src, err := ioutil.ReadFile(astFileName)
-		if err != nil {
-			continue
+// GenerateFromAST is like Generate but generates the packages for the
+// already parsed package pkg, whose import path is importPath, without
+// reading anything from disk. The generated packages' import paths are
+// under basePkg and the returned files' paths are relative to the
+// directory of basePkg.
+func GenerateFromAST(pkg *ast.Package, importPath, basePkg string) ([]GeneratedFile, error) {
+	opts := Options{Input: importPath, BasePkg: basePkg}
+	return generate(context.Background(), opts, func() (map[string]*Package, error) {
+		if len(pkg.Files) == 0 {
+			return nil, fmt.Errorf("%s: %w", importPath, ErrNoPackages)
 		}
-		for _, decl := range astFile.Decls {
-			if _, fd := maker.GetReceiverTypeName(src, decl); fd == nil {
-				if fd, ok := decl.(*ast.FuncDecl); ok {
-					if fd.Name != nil {
-
-						params := getMethodFields(src, fd.Type.Params.List)
-						results := []*Field{}
-						if fd.Type.Results != nil {
-							results = getMethodFields(src,
-								fd.Type.Results.List)
-						}
-						funcs = append(funcs, &Function{
-							Name:    fd.Name.Name,
-							Params:  params,
-							Results: results,
-						})
-					}
-				}
-			}
+
+		fileNames := make([]string, 0, len(pkg.Files))
+		for fileName := range pkg.Files {
+			fileNames = append(fileNames, fileName)
 		}
-	}
+		sort.Strings(fileNames)
 
-	return funcs, nil
+		decls := newPkgDecls()
+		for _, fileName := range fileNames {
+			decls.addFile(fileName, pkg.Files[fileName], nil)
+		}
+		if err := decls.err(); err != nil {
+			return nil, err
+		}
+		return map[string]*Package{
+			pkg.Name: decls.Package(pkg.Name, importPath),
+		}, nil
+	})
 }
 
-func getStructs(pkg *ast.Package) ([]*Struct, error) {
-	structMap := make(map[string]*Struct)
-
-	methods, err := getMethods(pkg)
-	if err != nil {
-		return nil, err
+// generate generates the files for the packages returned by load.
+func generate(ctx context.Context, opts Options, load func() (map[string]*Package, error)) ([]GeneratedFile, error) {
+	if opts.BuildTag != "" && !isBuildTag(opts.BuildTag) {
+		return nil, usageError{fmt.Errorf("invalid build tag %q",
+			opts.BuildTag)}
 	}
 
-	fields, err := getFields(pkg)
-	if err != nil {
-		return nil, err
+	if opts.ParentField == "" {
+		opts.ParentField = "parent"
 	}
 
-	for st, stmethods := range methods {
-		structMap[st] = &Struct{
-			Name:    st,
-			Methods: stmethods,
-		}
+	switch opts.Order {
+	case "", "source", "name":
+	default:
+		return nil, usageError{fmt.Errorf("invalid order %q, expected "+
+			"source or name", opts.Order)}
 	}
-
-	for stName, stfields := range fields {
-		st, ok := structMap[stName]
-		if !ok {
-			st = &Struct{
-				Name:   stName,
-				Fields: stfields,
-			}
-		} else {
-			st.Fields = stfields
-		}
-		structMap[stName] = st
+	if !token.IsIdentifier(opts.ParentField) {
+		return nil, usageError{fmt.Errorf("invalid parent field name %q",
+			opts.ParentField)}
+	}
+	if name := opts.IfaceNamePrefix + "X"; !token.IsIdentifier(name) ||
+		!ast.IsExported(name) {
+		return nil, usageError{fmt.Errorf("invalid interface name "+
+			"prefix %q", opts.IfaceNamePrefix)}
+	}
+	if !token.IsIdentifier("X" + opts.IfaceNameSuffix) {
+		return nil, usageError{fmt.Errorf("invalid interface name "+
+			"suffix %q", opts.IfaceNameSuffix)}
 	}
 
-	structs := make([]*Struct, 0)
-	for _, st := range structMap {
-		structs = append(structs, st)
+	if opts.IfaceOutput == "" {
+		opts.IfaceOutput = opts.Output
+	}
+	if opts.IfaceBasePkg == "" {
+		opts.IfaceBasePkg = opts.BasePkg
+	}
+	if opts.ImplOutput == "" {
+		opts.ImplOutput = opts.Output
+	}
+	if opts.ImplBasePkg == "" {
+		opts.ImplBasePkg = opts.BasePkg
 	}
 
-	return structs, nil
-}
+	ifacePkgs, implPkgs, genErr := genCode(ctx, opts, load)
+	if genErr != nil && !opts.ContinueOnError {
+		return nil, genErr
+	}
 
-func getMethods(pkg *ast.Package) (map[string][]*Method, error) {
-	methodMap := make(map[string][]*Method)
-	for fileName, astFile := range pkg.Files {
-		for _, decl := range astFile.Decls {
-			src, err := ioutil.ReadFile(fileName)
+	var files []GeneratedFile
+	for pkgName, pkg := range ifacePkgs {
+		files = append(files, GeneratedFile{
+			Path:   path.Join(opts.IfaceOutput, pkgName, pkgName+".go"),
+			Source: []byte(pkg),
+		})
+	}
+	for pkgName, pkg := range implPkgs {
+		files = append(files, GeneratedFile{
+			Path:   path.Join(opts.ImplOutput, pkgName, pkgName+".go"),
+			Source: []byte(pkg),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	if opts.NoHeader || opts.NoPackage {
+		for i := range files {
+			src, err := trimPreamble(files[i].Source, opts.NoHeader,
+				opts.NoPackage)
 			if err != nil {
-				continue
+				return nil, fmt.Errorf("%s: %v", files[i].Path, err)
 			}
-			a, fd := maker.GetReceiverTypeName(src, decl)
+			files[i].Source = src
+		}
+	}
 
-			if fd != nil && ast.IsExported(fd.Name.Name) {
-				methods, ok := methodMap[a]
-				if !ok {
-					methods = make([]*Method, 0)
-				}
+	if opts.BuildTag != "" {
+		constraint := fmt.Sprintf("//go:build %s\n// +build %s\n\n",
+			opts.BuildTag, opts.BuildTag)
+		for i := range files {
+			files[i].Source = append([]byte(constraint),
+				files[i].Source...)
+		}
+	}
 
-				// As per the docs, fd.Type.Params
-				// cannot be nil but fd.Type.Results
-				// can be
-				params := getMethodFields(src, fd.Type.Params.List)
-				results := []*Field{}
-				if fd.Type.Results != nil {
-					results = getMethodFields(src, fd.Type.Results.List)
-				}
-				methods = append(methods, &Method{
-					Name:    fd.Name.Name,
-					Params:  params,
-					Results: results,
-				})
-				methodMap[a] = methods
+	if opts.PostProcess != nil {
+		for i, file := range files {
+			processed, err := opts.PostProcess(file)
+			if err != nil {
+				return nil, fmt.Errorf("post-processing %s: %w",
+					file.Path, err)
 			}
+			files[i] = processed
 		}
 	}
 
-	return methodMap, nil
+	return files, genErr
 }
 
-func getMethodFields(src []byte, astFields []*ast.Field) []*Field {
-	var fields []*Field
+func genCode(ctx context.Context, opts Options, load func() (map[string]*Package, error)) (map[string]string, map[string]string, error) {
+	// Packages that fail to load are reported along with the
+	// others if there are any and ContinueOnError is set.
+	var errs []error
+	subpkgs, err := load()
+	if err != nil {
+		if !opts.ContinueOnError || len(subpkgs) == 0 {
+			return nil, nil, err
+		}
+		errs = append(errs, err)
+	}
 
-	for _, astField := range astFields {
-		field := &Field{}
-		if len(astField.Names) > 0 {
-			field.Name = astField.Names[0].Name
+	var mk *marker
+	if opts.MarkerInterface != "" {
+		mk, err = loadMarker(opts.MarkerInterface)
+		if err != nil {
+			return nil, nil, err
 		}
+	}
 
-		field.Type = string(src[astField.Type.Pos()-1 : astField.Type.End()-1])
+	// A main package can't be imported, so it can't be wrapped. One
+	// next to the input package, such as a generator excluded from
+	// builds with a build constraint, is left out.
+	if _, ok := subpkgs["main"]; ok {
+		if len(subpkgs) == 1 {
+			return nil, nil, usageError{fmt.Errorf("%s is a main "+
+				"package: main packages can't be imported so their "+
+				"types can't be wrapped, move them to a separate "+
+				"package", opts.Input)}
+		}
+		delete(subpkgs, "main")
+		opts.warn(fmt.Errorf("%s has files in package main, which "+
+			"can't be imported, leaving them out", opts.Input))
+	}
 
-		fields = append(fields, field)
+	names := make([]string, 0, len(subpkgs))
+	for subpkgName := range subpkgs {
+		names = append(names, subpkgName)
 	}
+	sort.Strings(names)
 
-	return fields
-}
+	if err := checkGroups(subpkgs, opts.Groups); err != nil {
+		return nil, nil, usageError{err}
+	}
+	if err := checkExtraMethods(subpkgs, opts.ExtraMethods); err != nil {
+		return nil, nil, usageError{err}
+	}
 
-func getFields(pkg *ast.Package) (map[string][]*Field, error) {
-	fieldMap := make(map[string][]*Field)
-	for fileName, astFile := range pkg.Files {
-		src, err := ioutil.ReadFile(fileName)
+	ifacePkgsMap := make(map[string]string)
+	implPkgsMap := make(map[string]string)
+	for _, subpkgName := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		name, err := generatedName(subpkgName, opts.StripPrefix)
 		if err != nil {
+			if !opts.ContinueOnError {
+				return nil, nil, err
+			}
+			errs = append(errs, fmt.Errorf("package %s: %w",
+				subpkgName, err))
 			continue
 		}
 
-		fset := token.NewFileSet()
-		_, err = parser.ParseFile(fset, fileName, nil, parser.ParseComments)
-		if err != nil {
-			return nil, err
+		// The package's warnings, including the members skipped, go
+		// in its report.
+		report := newPackageReport(subpkgName)
+		pkgOpts := opts
+		pkgOpts.Warn = func(err error) {
+			report.warn(err)
+			opts.warn(err)
 		}
 
-		ast.Inspect(astFile, func(n ast.Node) bool {
-			if st, ok := n.(*ast.StructType); ok {
-				structName := getStructName(src, fset, st)
-				if ast.IsExported(structName) {
-					var exportedFields []*Field
-					for _, astField := range st.Fields.List {
-						if len(astField.Names) > 0 &&
-							astField.Names[0].IsExported() {
+		for _, warning := range subpkgs[subpkgName].Warnings {
+			pkgOpts.warn(warning)
+		}
 
-							field := &Field{}
-							field.Name = astField.Names[0].Name
-							field.Type = string(src[astField.Type.Pos()-1 : astField.Type.End()-1])
+		groups := groupStructs(subpkgs[subpkgName], name, opts.Groups)
+		groupNames := make([]string, 0, len(groups))
+		for group := range groups {
+			groupNames = append(groupNames, group)
+		}
+		sort.Strings(groupNames)
 
-							exportedFields = append(exportedFields,
-								field)
-						}
-					}
-					fieldMap[structName] = exportedFields
+		for _, group := range groupNames {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+			ifacePkg, implPkg, fakesPkg, err := genSubpackage(pkgOpts,
+				subpkgName, group, groups[group], mk)
+			if err != nil {
+				if !opts.ContinueOnError {
+					return nil, nil, err
 				}
+				errs = append(errs, fmt.Errorf("package %s: %w",
+					subpkgName, err))
+				continue
 			}
-			return true
-		})
+			report.wrapped(groups[group])
+			if ifacePkg != "" {
+				ifacePkgsMap[group+"iface"] = ifacePkg
+			}
+			if implPkg != "" {
+				implPkgsMap[group] = implPkg
+			}
+			// The fakes are put alongside the interfaces they
+			// implement.
+			if fakesPkg != "" {
+				ifacePkgsMap[group+"fakes"] = fakesPkg
+			}
+		}
+
+		if opts.Report != nil {
+			opts.Report(*report)
+		}
 	}
-	return fieldMap, nil
-}
 
-func getStructName(src []byte, fset *token.FileSet, st *ast.StructType) string {
-	lines := strings.Split(string(src), "\n")
-	line := lines[fset.Position(st.Pos()).Line-1]
-	return strings.Split(line, " ")[1]
+	return ifacePkgsMap, implPkgsMap, errors.Join(errs...)
 }
 
-func buildIfaces(pkg *Package) ([]string, error) {
-	var ifaces []string
-
-	iface := `
-type {{.Name}} interface {
-{{ range $field := .Fields }}
-    {{ $field.Name }}() {{ $field.Type }}
-{{ end }}
+// checkGroups checks that every struct in groups is one of the structs
+// of subpkgs and that the groups are valid package names.
+func checkGroups(subpkgs map[string]*Package, groups map[string]string) error {
+	structs := make(map[string]bool)
+	for _, subpkg := range subpkgs {
+		for _, st := range subpkg.Structs {
+			structs[st.Name] = true
+		}
+	}
 
-{{ range $method := .Methods }}
-    {{ $method.Name }}({{ toList $method.Params }}) ({{ toList $method.Results }})
-{{ end }}
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !structs[name] {
+			return fmt.Errorf("can't group %s: there is no such struct",
+				name)
+		}
+		if group := groups[name]; !token.IsIdentifier(group) ||
+			group == "_" || group == "main" {
+			return fmt.Errorf("can't group %s: %q isn't a valid "+
+				"package name", name, group)
+		}
+	}
+	return nil
 }
+
+// groupStructs splits pkg into a package per group of groups its structs
+// are in, keyed by the group's name. The structs that aren't in a group,
+// along with the functions, are in the group name. Structs referring to
+// structs in another group use them as is rather than their interfaces,
+// as each group's wrappers can only unwrap their own structs.
+func groupStructs(pkg *Package, name string, groups map[string]string) map[string]*Package {
+	if len(groups) == 0 {
+		return map[string]*Package{name: pkg}
+	}
+
+	grouped := make(map[string]*Package)
+	groupOf := func(group string) *Package {
+		if grouped[group] == nil {
+			grouped[group] = &Package{
+				Name:       pkg.Name,
+				TypeNames:  pkg.TypeNames,
+				ImportPath: pkg.ImportPath,
+				Imports:    pkg.Imports,
+				Deprecated: pkg.Deprecated,
+			}
+		}
+		return grouped[group]
+	}
+	for _, st := range pkg.Structs {
+		group, ok := groups[st.Name]
+		if !ok {
+			group = name
+		}
+		groupOf(group).Structs = append(groupOf(group).Structs, st)
+	}
+	if len(pkg.Functions) > 0 {
+		groupOf(name).Functions = pkg.Functions
+	}
+	return grouped
+}
+
+// warn reports the warning err, passing it to opts.Warn if it's set and
+// logging it otherwise.
+func (opts Options) warn(err error) {
+	if opts.Warn != nil {
+		opts.Warn(err)
+		return
+	}
+	log.Printf("warning: %v", err)
+}
+
+// generatedName returns the name the packages generated for the package
+// pkgName are based on, pkgName without prefix. It's an error if that
+// isn't a valid package name.
+func generatedName(pkgName, prefix string) (string, error) {
+	name := strings.TrimPrefix(pkgName, prefix)
+	if !token.IsIdentifier(name) || name == "_" || name == "main" {
+		return "", usageError{fmt.Errorf("stripping %q from %s "+
+			"leaves %q, which isn't a valid package name", prefix,
+			pkgName, name)}
+	}
+	return name, nil
+}
+
+// genSubpackage generates the source of the interface and
+// implementation packages for subpkg, the package called subpkgName.
+// The package of fakes is also generated if opts.GenFakes is set. They
+// are "" if the package is skipped or they aren't wanted. The generated
+// packages are named after name.
+func genSubpackage(opts Options, subpkgName, name string, subpkg *Package, mk *marker) (string, string, string, error) {
+	ifaceTmpl := `// Auto generated code DO NOT EDIT
+
+{{ .Doc }}
+package {{.Name}}iface
+{{- with .Imports }}
+
+import (
+{{- range . }}
+    {{ . }}
+{{- end }}
+)
+{{- end }}
+{{- range $iface := .Interfaces }}
+
+{{ $iface }}
+{{- end }}
+{{- with .Funcs }}
+
+{{ . }}
+{{- end }}
 `
 
-	ifaceTmpl, err := template.New("iface").Funcs(template.FuncMap{
-		"toList": func(fields []*Field) string {
-			var list string
-			prefix := ""
-			for _, field := range fields {
-				list += prefix + field.Name + " " + field.Type
-				prefix = ", "
+	implTmpl := `// Auto generated code DO NOT EDIT
+
+{{ .Doc }}
+package {{.Name}}
+{{- with .Imports }}
+
+import (
+{{- range . }}
+    {{ . }}
+{{- end }}
+)
+{{- end }}
+{{- range $impl := .Implementations }}
+
+{{ $impl }}
+{{- end }}
+{{- range $func := .Funcs }}
+
+{{ $func }}
+{{- end }}
+`
+	if opts.SkipDeprecated {
+		skipDeprecated(subpkg)
+	}
+
+	for _, st := range subpkg.Structs {
+		if opts.NoFieldAccessors {
+			st.Fields = nil
+		}
+		st.Fields = exportableFields(subpkgName, st, opts.warn)
+		st.Methods = exportableMethods(subpkgName, st, opts.warn)
+		all := st.Methods
+		st.Methods = excludeMethods(st.Name, st.Methods,
+			opts.ExcludeMethods)
+		if err := addExtraMethods(subpkgName, st, all,
+			opts.ExtraMethods[st.Name]); err != nil {
+			return "", "", "", usageError{err}
+		}
+		setGetters(subpkgName, st, opts.GetterPrefix, opts.warn)
+		warnWellKnown(subpkgName, st, opts.warn)
+		if opts.Order == "name" {
+			sort.SliceStable(st.Fields, func(i, j int) bool {
+				return st.Fields[i].Getter < st.Fields[j].Getter
+			})
+			sort.SliceStable(st.Methods, func(i, j int) bool {
+				return st.Methods[i].Name < st.Methods[j].Name
+			})
+		}
+	}
+	subpkg.Structs = limitMethods(subpkgName, subpkg.Structs,
+		opts.MaxMethods, opts.warn)
+	subpkg.Functions = exportableFunctions(subpkgName,
+		subpkg.Functions, opts.warn)
+	if opts.Order == "name" {
+		sort.SliceStable(subpkg.Functions, func(i, j int) bool {
+			return subpkg.Functions[i].Name < subpkg.Functions[j].Name
+		})
+	}
+
+	if len(subpkg.Structs) == 0 && len(subpkg.Functions) == 0 {
+		log.Printf("package %s: no exported types to wrap, skipping",
+			subpkgName)
+		return "", "", "", nil
+	}
+
+	if err := checkIfaceNames(subpkg, opts); err != nil {
+		return "", "", "", err
+	}
+	if err := checkImplNames(subpkg); err != nil {
+		return "", "", "", err
+	}
+
+	ifacePath := path.Join(opts.IfaceBasePkg, name+"iface")
+	ifaceMapper := newTypeMapper(subpkg, "", ifacePath)
+	ifaceMapper.ifacePrefix = opts.IfaceNamePrefix
+	ifaceMapper.ifaceSuffix = opts.IfaceNameSuffix
+	if mk != nil {
+		ifaceMapper.addImport(mk.importPath, mk.pkgName)
+	}
+	ifaces, err := buildIfaces(subpkg, ifaceMapper, mk,
+		opts.ProvenanceComments)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	funcsIface, err := buildFuncsIface(subpkg, ifaceMapper, mk,
+		opts.ProvenanceComments)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	ifacePkgBuf := new(bytes.Buffer)
+
+	tmpl, err := template.New("iface").Parse(ifaceTmpl)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = tmpl.Execute(ifacePkgBuf, struct {
+		Name       string
+		Doc        string
+		Imports    []string
+		Interfaces []string
+		Funcs      string
+	}{
+		Name: name,
+		Doc: packageDoc(name+"iface", opts.PackageDoc,
+			"contains the generated interfaces of "+subpkgName+"."),
+		Imports:    ifaceMapper.Imports(),
+		Interfaces: ifaces,
+		Funcs:      funcsIface,
+	})
+
+	ifacePkg, err := formatSource(ifacePkgBuf.Bytes())
+	if err != nil {
+		return "", "", "", err
+	}
+
+	checkInternalImports(ifacePath, ifacePkg, opts.warn)
+
+	var fakesPkg string
+	if opts.GenFakes {
+		fakesPkg, err = genFakesPkg(subpkg, name, ifacePath, opts, mk)
+		if err != nil {
+			return "", "", "", err
+		}
+		checkInternalImports(path.Join(opts.IfaceBasePkg, name+"fakes"),
+			[]byte(fakesPkg), opts.warn)
+	}
+
+	if opts.IfacesOnly {
+		return string(ifacePkg), "", fakesPkg, nil
+	}
+
+	implMapper := newTypeMapper(subpkg, name+"iface", ifacePath)
+	implMapper.ifacePrefix = opts.IfaceNamePrefix
+	implMapper.ifaceSuffix = opts.IfaceNameSuffix
+	if shadowsPackage(subpkg) {
+		implMapper.aliasPkg()
+	}
+	// The wrapped package is always used, if only to forward to.
+	implMapper.addImport(subpkg.ImportPath, implMapper.pkgName)
+	impls, err := buildImpls(subpkg, implMapper, opts, mk)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	funcs, err := buildFuncs(subpkg, implMapper)
+	if err != nil {
+		return "", "", "", err
+	}
+	funcsImpl, err := buildFuncsImpl(subpkg, implMapper, mk)
+	if err != nil {
+		return "", "", "", err
+	}
+	if funcsImpl != "" {
+		funcs = append(funcs, funcsImpl)
+	}
+
+	implPkgBuf := new(bytes.Buffer)
+	tmpl, err = template.New("impl").Parse(implTmpl)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = tmpl.Execute(implPkgBuf, struct {
+		Name            string
+		Doc             string
+		Imports         []string
+		Implementations []string
+		Funcs           []string
+	}{
+		Name: name,
+		Doc: packageDoc(name, opts.PackageDoc, "contains the "+
+			"generated wrappers implementing the interfaces in "+
+			name+"iface."),
+		Imports:         implMapper.Imports(),
+		Implementations: impls,
+		Funcs:           funcs,
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+
+	implPkg, err := formatSource(implPkgBuf.Bytes())
+	if err != nil {
+		return "", "", "", err
+	}
+
+	checkInternalImports(path.Join(opts.ImplBasePkg, name), implPkg,
+		opts.warn)
+
+	return string(ifacePkg), string(implPkg), fakesPkg, nil
+}
+
+// generatedHeader is the first line of every generated file.
+const generatedHeader = "// Auto generated code DO NOT EDIT\n"
+
+// trimPreamble removes the generated file src's header if noHeader is
+// set and its package clause and doc comment if noPackage is set.
+func trimPreamble(src []byte, noHeader, noPackage bool) ([]byte, error) {
+	if noPackage {
+		astFile, err := parser.ParseFile(token.NewFileSet(), "", src,
+			parser.PackageClauseOnly|parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		start := astFile.Package
+		if astFile.Doc != nil {
+			start = astFile.Doc.Pos()
+		}
+		rest := bytes.TrimLeft(src[astFile.Name.End()-1:], "\n")
+		src = append(src[:start-1:start-1], rest...)
+	}
+	if noHeader {
+		src = bytes.TrimLeft(bytes.TrimPrefix(src,
+			[]byte(generatedHeader)), "\n")
+	}
+	return src, nil
+}
+
+// packageDoc returns the doc comment of the generated package pkg,
+// "Package <pkg> " followed by doc or, if doc is "", by def.
+func packageDoc(pkg, doc, def string) string {
+	if doc == "" {
+		doc = def
+	}
+	lines := strings.Split(strings.TrimSpace(doc), "\n")
+	lines[0] = "Package " + pkg + " " + lines[0]
+	return "// " + strings.Join(lines, "\n// ")
+}
+
+// comment returns text as a // comment.
+func comment(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight("// "+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isBuildTag reports whether tag is a valid build tag name.
+func isBuildTag(tag string) bool {
+	if tag == "" {
+		return false
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+			r != '_' && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// internalParent returns the directory that code must live under to
+// import pkg. If pkg is not an internal package it returns "".
+func internalParent(pkg string) string {
+	elems := strings.Split(pkg, "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		if elems[i] == "internal" {
+			return strings.Join(elems[:i], "/")
+		}
+	}
+	return ""
+}
+
+// canImport reports whether the package at importer is allowed to
+// import pkg under Go's internal package rules.
+func canImport(importer, pkg string) bool {
+	parent := internalParent(pkg)
+	if parent == "" {
+		return true
+	}
+	return importer == parent || strings.HasPrefix(importer, parent+"/")
+}
+
+// checkInternalImports calls warn with an *InternalImportError for each
+// package the generated package src, with the import path importPath,
+// imports but isn't allowed to, as it wouldn't compile.
+func checkInternalImports(importPath string, src []byte, warn func(error)) {
+	astFile, err := parser.ParseFile(token.NewFileSet(), "", src,
+		parser.ImportsOnly)
+	if err != nil {
+		return
+	}
+	for _, spec := range astFile.Imports {
+		pkg, err := strconv.Unquote(spec.Path.Value)
+		if err == nil && !canImport(importPath, pkg) {
+			warn(&InternalImportError{Importer: importPath, Package: pkg})
+		}
+	}
+}
+
+// pkgFiles returns the names of the source files of the package with
+// the import path pkg. Files that only exist in overlay are included.
+func pkgFiles(pkg string, overlay map[string][]byte) ([]string, error) {
+	dir := pkgDir(pkg)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	isSource := func(name string) bool {
+		return strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go")
+	}
+
+	var fileNames []string
+	for _, info := range infos {
+		if !info.IsDir() && isSource(info.Name()) {
+			fileNames = append(fileNames, path.Join(dir, info.Name()))
+		}
+	}
+	for fileName := range overlay {
+		_, err := os.Stat(fileName)
+		if path.Dir(fileName) == dir && isSource(path.Base(fileName)) &&
+			os.IsNotExist(err) {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	sort.Strings(fileNames)
+
+	return fileNames, nil
+}
+
+// readSource returns the contents of fileName, preferring those in
+// overlay to those on disk.
+func readSource(fileName string, overlay map[string][]byte) ([]byte, error) {
+	if src, ok := overlay[fileName]; ok {
+		return src, nil
+	}
+	return ioutil.ReadFile(fileName)
+}
+
+// buildFuncs builds a function forwarding to each of pkg's functions,
+// using m to map their types.
+func buildFuncs(pkg *Package, m *typeMapper) ([]string, error) {
+	fn := `func {{ .Name }}({{ toList .Params }}){{ with results .Results }} {{ . }}{{ end }} {
+    {{ forward (printf "%s.%s" .PkgName .Name) .Params .Results }}
+}
+`
+	fnTmpl, err := template.New("fn").Funcs(template.FuncMap{
+		"toList":  m.fieldList,
+		"results": m.resultList,
+		"forward": m.forward,
+	}).Parse(fn)
+	if err != nil {
+		return []string{}, err
+	}
+
+	var funcs []string
+	for _, fn := range pkg.Functions {
+		params, results := m.unshadow(fn.Params, fn.Results)
+		buf := new(bytes.Buffer)
+		err := fnTmpl.Execute(buf, struct {
+			PkgName string
+			Name    string
+			Params  []*Field
+			Results []*Field
+		}{
+			PkgName: m.pkgName,
+			Name:    fn.Name,
+			Params:  params,
+			Results: results,
+		})
+		if err != nil {
+			return []string{}, err
+		}
+
+		funcs = append(funcs, buf.String())
+	}
+
+	return funcs, nil
+}
+
+// buildFuncsImpl builds a struct implementing the interface grouping
+// pkg's functions by calling the functions built by buildFuncs, along
+// with a default instance and a constructor, so that code can be given
+// the functions and tests a fake of them. The struct is given the
+// methods of mk, if it's set, that it doesn't have. If pkg has no
+// exported functions it returns "".
+func buildFuncsImpl(pkg *Package, m *typeMapper, mk *marker) (string, error) {
+	if len(pkg.Functions) == 0 {
+		return "", nil
+	}
+
+	impl := `// {{ .Type }} implements {{ .Iface }} by calling the functions of {{ .Pkg }}.
+type {{ .Type }} struct{}
+
+var _ {{ .Iface }} = {{ .Type }}{}
+
+// {{ .Default }} calls the functions of {{ .Pkg }}.
+var {{ .Default }} {{ .Iface }} = {{ .Type }}{}
+
+// {{ .Constructor }} returns a {{ .Iface }} calling the functions of {{ .Pkg }}.
+func {{ .Constructor }}() {{ .Iface }} {
+    return {{ .Type }}{}
+}
+{{- range $fn := .Functions }}
+
+func ({{ $.Type }}) {{ $fn.Name }}({{ toList $fn.Params }}){{ with results $fn.Results }} {{ . }}{{ end }} {
+    {{ if $fn.Results }}return {{ end }}{{ $fn.Name }}({{ args $fn.Params }})
+}
+{{- end }}`
+
+	implTmpl, err := template.New("funcsImpl").Funcs(template.FuncMap{
+		"toList":  m.fieldList,
+		"results": m.resultList,
+		"args":    callArgs,
+	}).Parse(impl)
+	if err != nil {
+		return "", err
+	}
+
+	// The interface package isn't otherwise imported if none of the
+	// functions use the package's structs.
+	m.addImport(m.ifacePath, m.ifaceName)
+	name := funcsIfaceName(pkg)
+	buf := new(bytes.Buffer)
+	err = implTmpl.Execute(buf, struct {
+		Type        string
+		Iface       string
+		Default     string
+		Constructor string
+		Pkg         string
+		Functions   []*Function
+	}{
+		Type:        lowerFirst(name),
+		Iface:       m.ifaceName + "." + m.ifaceTypeName(name),
+		Default:     "Default" + name,
+		Constructor: constructorName(pkg, name),
+		Pkg:         pkg.Name,
+		Functions:   pkg.Functions,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	stubs := mk.stubs(lowerFirst(name), methodNames(funcMethods(pkg)), m)
+	return strings.Join(append([]string{buf.String()}, stubs...), "\n\n"), nil
+}
+
+// getSubpackages parses the package with the import path pkg, using
+// the contents of files in overlay in place of those on disk. The files
+// are processed one at a time so that only a single file's source and
+// AST are held in memory at once. It stops early if ctx is done.
+func getSubpackages(ctx context.Context, pkg string, overlay map[string][]byte) (map[string]*Package, error) {
+	fileNames, err := pkgFiles(pkg, overlay)
+	if err != nil {
+		return nil, parseError{err}
+	}
+	if len(fileNames) == 0 {
+		return nil, parseError{fmt.Errorf("%s: %w", pkg, ErrNoPackages)}
+	}
+
+	decls := make(map[string]*pkgDecls)
+	// broken maps the packages with files that don't parse, or whose
+	// declarations conflict, to the first of their errors.
+	broken := make(map[string]error)
+	for _, fileName := range fileNames {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		src, err := readSource(fileName, overlay)
+		if err != nil {
+			return nil, parseError{err}
+		}
+
+		astFile, err := parseFile(token.NewFileSet(), fileName, src,
+			parser.DeclarationErrors|parser.ParseComments)
+		if err != nil {
+			// A file whose package clause parses only breaks its
+			// own package, the directory's others can still be
+			// generated.
+			if astFile == nil || astFile.Name.Name == "" {
+				return nil, parseError{err}
+			}
+			if _, ok := broken[astFile.Name.Name]; !ok {
+				broken[astFile.Name.Name] = err
+			}
+			continue
+		}
+
+		name := astFile.Name.Name
+		if _, ok := decls[name]; !ok {
+			decls[name] = newPkgDecls()
+		}
+		decls[name].addFile(fileName, astFile, src)
+	}
+	for name, d := range decls {
+		if _, ok := broken[name]; !ok {
+			if err := d.err(); err != nil {
+				broken[name] = err
+			}
+		}
+	}
+
+	subpkgMap := make(map[string]*Package)
+	for subpkgName, subpkgDecls := range decls {
+		// Resolving the package's types may load other packages.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, ok := broken[subpkgName]; !ok {
+			subpkgMap[subpkgName] = subpkgDecls.Package(subpkgName, pkg)
+		}
+	}
+
+	if len(broken) > 0 {
+		names := make([]string, 0, len(broken))
+		for name := range broken {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		errs := make([]error, len(names))
+		for i, name := range names {
+			errs[i] = fmt.Errorf("package %s: %w", name, broken[name])
+		}
+		// The packages that parsed are returned too, so that they
+		// can still be generated with ContinueOnError.
+		return subpkgMap, parseError{errors.Join(errs...)}
+	}
+
+	return subpkgMap, nil
+}
+
+// pkgDecls are the declarations collected from the files of a package.
+type pkgDecls struct {
+	methods map[string][]*Method
+	fields  map[string][]*Field
+	embeds  map[string][]string
+	funcs   []*Function
+	// funcNames are the names of funcs, to leave out functions declared
+	// again in another build-tag variant of a file.
+	funcNames map[string]bool
+	typeNames []string
+	typeDocs  map[string]string
+	// typeParams are the type parameters of the generic types, by
+	// name.
+	typeParams map[string][]*Field
+	imports    map[string]string
+	dotFields  []dotFields
+	warnings   []error
+	// deprecated are the deprecated members, as for
+	// Package.Deprecated.
+	deprecated map[string]bool
+	// receivers are the files declaring each method, keyed by
+	// <Type>.<Method>, and whether they have value receivers.
+	receivers map[string]receiverDecl
+	// conflicts are the errors that stop the package being generated.
+	conflicts []error
+	// loaded caches the packages whose type information has been
+	// loaded, by import path. It's nil for those that failed to load.
+	loaded map[string]*types.Package
+}
+
+// receiverDecl is where a method is declared and its receiver kind.
+type receiverDecl struct {
+	fileName string
+	value    bool
+}
+
+// dotFields are the fields declared in a file with the dot imports
+// dots.
+type dotFields struct {
+	fields []scopedFields
+	dots   []string
+}
+
+// scopedFields are fields declared where the type parameters typeParams
+// are in scope, so the identifiers naming them aren't dot-imported
+// types.
+type scopedFields struct {
+	fields     []*Field
+	typeParams map[string]bool
+}
+
+func newPkgDecls() *pkgDecls {
+	return &pkgDecls{
+		methods:    make(map[string][]*Method),
+		fields:     make(map[string][]*Field),
+		embeds:     make(map[string][]string),
+		typeDocs:   make(map[string]string),
+		typeParams: make(map[string][]*Field),
+		imports:    make(map[string]string),
+		deprecated: make(map[string]bool),
+		receivers:  make(map[string]receiverDecl),
+		funcNames:  make(map[string]bool),
+		loaded:     make(map[string]*types.Package),
+	}
+}
+
+// addFile collects the declarations in astFile, whose source is src,
+// read from fileName. Nothing collected refers to astFile or src.
+func (d *pkgDecls) addFile(fileName string, astFile *ast.File, src []byte) {
+	var fileFields []scopedFields
+	typeParams := getTypeParams(astFile, src)
+
+	for st, methods := range getMethods(astFile, src, d.warn) {
+		for _, method := range methods {
+			if !d.addReceiver(astFile.Name.Name, st, method, fileName) {
+				continue
+			}
+			d.methods[st] = append(d.methods[st], method)
+			recvParams := make(map[string]bool)
+			for _, name := range method.RecvTypeParams {
+				recvParams[name] = true
+			}
+			fileFields = append(fileFields, scopedFields{
+				fields: append(append([]*Field{}, method.Params...),
+					method.Results...),
+				typeParams: recvParams,
+			})
+		}
+	}
+	fields, embeds := getFields(astFile, src)
+	for st, stFields := range fields {
+		d.fields[st] = stFields
+		d.embeds[st] = embeds[st]
+		fileFields = append(fileFields, scopedFields{
+			fields:     stFields,
+			typeParams: typeParamNames(typeParams[st]),
+		})
+	}
+	for _, fn := range getFunctions(astFile, src, d.warn) {
+		if d.funcNames[fn.Name] {
+			continue
+		}
+		d.funcNames[fn.Name] = true
+		d.funcs = append(d.funcs, fn)
+		fileFields = append(fileFields, scopedFields{
+			fields: append(append([]*Field{}, fn.Params...),
+				fn.Results...),
+		})
+	}
+	d.typeNames = append(d.typeNames, getTypeNames(astFile)...)
+	for name, doc := range getTypeDocs(astFile) {
+		d.typeDocs[name] = doc
+	}
+	for _, name := range getDeprecated(astFile, src) {
+		d.deprecated[name] = true
+	}
+	for name, params := range typeParams {
+		d.typeParams[name] = params
+	}
+	for name, importPath := range getImports(astFile) {
+		d.addImport(astFile.Name.Name, name, importPath)
+	}
+
+	// Which package a dot-imported type comes from can only be told
+	// once all the package's own types are known.
+	if dots := getDotImports(astFile); len(dots) > 0 {
+		d.dotFields = append(d.dotFields, dotFields{
+			fields: fileFields,
+			dots:   dots,
+		})
+	}
+}
+
+// addReceiver records that method of the type st of the package pkg is
+// declared in fileName, recording a conflict if it's declared
+// elsewhere with the other kind of receiver. It returns false if the
+// method was already declared, e.g. in another build-tag variant of the
+// file, in which case only the first declaration is wrapped.
+func (d *pkgDecls) addReceiver(pkg, st string, method *Method, fileName string) bool {
+	key := st + "." + method.Name
+	prev, ok := d.receivers[key]
+	if !ok {
+		d.receivers[key] = receiverDecl{fileName, method.ValueRecv}
+		return true
+	}
+	if prev.value == method.ValueRecv {
+		return false
+	}
+	err := &ReceiverConflictError{
+		Method:      pkg + "." + key,
+		ValueFile:   prev.fileName,
+		PointerFile: fileName,
+	}
+	if !prev.value {
+		err.ValueFile, err.PointerFile = fileName, prev.fileName
+	}
+	d.conflicts = append(d.conflicts, err)
+	return false
+}
+
+// err returns the conflicts between the package's declarations.
+func (d *pkgDecls) err() error {
+	return errors.Join(d.conflicts...)
+}
+
+// warn records the warning err, to be reported when the package is
+// generated.
+func (d *pkgDecls) warn(err error) {
+	d.warnings = append(d.warnings, err)
+}
+
+// addImport records that the package pkg refers to the package with the
+// given import path as name.
+func (d *pkgDecls) addImport(pkg, name, importPath string) {
+	if other, ok := d.imports[name]; ok && other != importPath {
+		d.warn(fmt.Errorf("package %s refers to both %s and %s as %s, "+
+			"using %s", pkg, other, importPath, name, other))
+		return
+	}
+	d.imports[name] = importPath
+}
+
+// resolveDotImports qualifies the types in the fields of files with dot
+// imports that are declared by a dot-imported package, rather than by
+// the package pkg or as type parameters, so they refer to that package.
+func (d *pkgDecls) resolveDotImports(pkg string) {
+	local := make(map[string]bool)
+	for _, name := range d.typeNames {
+		local[name] = true
+	}
+
+	for _, df := range d.dotFields {
+		for _, scoped := range df.fields {
+			for _, field := range scoped.fields {
+				field.Type = rewriteType(field.Type, func(ident *ast.Ident) ast.Expr {
+					if !ident.IsExported() || local[ident.Name] ||
+						scoped.typeParams[ident.Name] {
+						return ident
+					}
+					importPath, name, ok := d.dotImport(ident.Name, df.dots)
+					if !ok {
+						d.warn(fmt.Errorf("package %s: can't tell "+
+							"which dot import %s is from", pkg, ident.Name))
+					}
+					if importPath == "" {
+						return ident
+					}
+					d.addImport(pkg, name, importPath)
+					return &ast.SelectorExpr{X: ast.NewIdent(name), Sel: ident}
+				})
+			}
+		}
+	}
+}
+
+// dotImport returns the import path and name of the package, out of the
+// dot imports dots, that declares name. It returns "" for the import
+// path if none of them does, and false if that can't be told, because
+// several of them declare name or none does but some can't be loaded.
+// A single dot import that can't be loaded is assumed to declare name.
+func (d *pkgDecls) dotImport(name string, dots []string) (string, string, bool) {
+	var importPath, pkgName string
+	ok := true
+	for _, dot := range dots {
+		pkg := d.load(dot)
+		if pkg == nil {
+			if len(dots) == 1 {
+				return dot, importName(dot), true
+			}
+			ok = false
+			continue
+		}
+		if pkg.Scope().Lookup(name) == nil {
+			continue
+		}
+		if importPath != "" {
+			return "", "", false
+		}
+		importPath, pkgName = dot, pkg.Name()
+	}
+	if importPath == "" && !ok {
+		return "", "", false
+	}
+	return importPath, pkgName, true
+}
+
+// load returns the type information of the package with the given
+// import path, or nil if it can't be loaded. Failing to load a package
+// only means some types can't be resolved, which the caller warns
+// about.
+func (d *pkgDecls) load(importPath string) *types.Package {
+	pkg, ok := d.loaded[importPath]
+	if !ok {
+		pkg, _ = importer.ForCompiler(token.NewFileSet(), "source",
+			nil).Import(importPath)
+		d.loaded[importPath] = pkg
+	}
+	return pkg
+}
+
+// foreignEmbeds returns the exported methods of the foreign types
+// embedded in the package pkg's structs, as structs keyed by how the
+// embedded types are written. Finding them needs the foreign packages'
+// type information, so embedded types whose package can't be loaded are
+// warned about and left out.
+func (d *pkgDecls) foreignEmbeds(pkg string) map[string]*Struct {
+	var embeds []string
+	for _, stEmbeds := range d.embeds {
+		embeds = append(embeds, stEmbeds...)
+	}
+	sort.Strings(embeds)
+
+	foreign := make(map[string]*Struct)
+	for _, embed := range embeds {
+		name := strings.TrimPrefix(embed, "*")
+		i := strings.Index(name, ".")
+		if i < 0 || foreign[embed] != nil {
+			continue
+		}
+
+		var obj types.Object
+		if foreignPkg := d.load(d.imports[name[:i]]); foreignPkg != nil {
+			obj = foreignPkg.Scope().Lookup(name[i+1:])
+		}
+		if _, ok := obj.(*types.TypeName); !ok {
+			d.warn(fmt.Errorf("package %s: can't load %s, leaving "+
+				"out the methods it promotes", pkg, name))
+			continue
+		}
+
+		foreign[embed] = &Struct{
+			Name: name,
+			Methods: typeMethods(name, obj.Type(),
+				strings.HasPrefix(embed, "*"), d.qualifier(pkg, nil),
+				d.warn),
+		}
+	}
+	return foreign
+}
+
+// typeMethods returns the exported methods of typ, called name, with
+// their types qualified by q. They're the methods of a pointer to typ,
+// unless typ is an interface as a pointer to an interface has no
+// methods. Methods with a value receiver are marked as such, as are all
+// of them if pointer is set because typ is embedded by pointer. Methods
+// referring to unexported foreign types are skipped, calling warn.
+func typeMethods(name string, typ types.Type, pointer bool, q types.Qualifier, warn func(error)) []*Method {
+	all := types.NewMethodSet(typ)
+	if !types.IsInterface(typ) {
+		all = types.NewMethodSet(types.NewPointer(typ))
+	}
+	values := types.NewMethodSet(typ)
+
+	var methods []*Method
+	for i := 0; i < all.Len(); i++ {
+		fn := all.At(i).Obj()
+		if !fn.Exported() {
+			continue
+		}
+		sig := fn.Type().(*types.Signature)
+		method := &Method{
+			Name:    fn.Name(),
+			Params:  nameParams(tupleFields(sig.Params(), sig.Variadic(), q)),
+			Results: tupleFields(sig.Results(), false, q),
+			ValueRecv: pointer ||
+				values.Lookup(fn.Pkg(), fn.Name()) != nil,
+		}
+		for i := 0; i < sig.RecvTypeParams().Len(); i++ {
+			method.RecvTypeParams = append(method.RecvTypeParams,
+				sig.RecvTypeParams().At(i).Obj().Name())
+		}
+		if typ := signatureForeignUnexported(method); typ != "" {
+			warn(&UnexportedDependencyError{
+				Member: name + "." + fn.Name(),
+				Type:   typ,
+			})
+			continue
+		}
+		methods = append(methods, method)
+	}
+	return methods
+}
+
+// qualifier returns a types.Qualifier qualifying types by the names of
+// their packages, which are imported by the package pkg. The types of
+// self, if it's set, are pkg's own types and are left unqualified.
+func (d *pkgDecls) qualifier(pkg string, self *types.Package) types.Qualifier {
+	return func(p *types.Package) string {
+		if p == self {
+			return ""
+		}
+		d.addImport(pkg, p.Name(), p.Path())
+		return p.Name()
+	}
+}
+
+// tupleFields returns the fields of the params or results tuple, with
+// their types qualified by q. If variadic is set, the last field is
+// variadic.
+func tupleFields(tuple *types.Tuple, variadic bool, q types.Qualifier) []*Field {
+	var fields []*Field
+	for i := 0; i < tuple.Len(); i++ {
+		v := tuple.At(i)
+		typ := types.TypeString(v.Type(), q)
+		if variadic && i == tuple.Len()-1 {
+			typ = "..." + types.TypeString(
+				v.Type().(*types.Slice).Elem(), q)
+		}
+		fields = append(fields, &Field{Name: v.Name(), Type: typ})
+	}
+
+	// Export data can give unnamed results made up names, such as
+	// #rv1, that can't be declared. Either all or none of a list's
+	// fields must be named, so none of them are.
+	for _, field := range fields {
+		if field.Name != "" && !token.IsIdentifier(field.Name) {
+			for _, field := range fields {
+				field.Name = ""
+			}
+			break
+		}
+	}
+	return fields
+}
+
+// signatureForeignUnexported returns the first unexported foreign type
+// referenced by method's params or results, which can't be named by the
+// generated code, or "" if there is none.
+func signatureForeignUnexported(method *Method) string {
+	for _, fields := range [][]*Field{method.Params, method.Results} {
+		for _, field := range fields {
+			expr, err := parseType(field.Type)
+			if err != nil {
+				continue
+			}
+			var unexported string
+			ast.Inspect(expr, func(n ast.Node) bool {
+				sel, ok := n.(*ast.SelectorExpr)
+				if ok && unexported == "" && !sel.Sel.IsExported() {
+					unexported = types.ExprString(sel)
+				}
+				return unexported == ""
+			})
+			if unexported != "" {
+				return unexported
+			}
+		}
+	}
+	return ""
+}
+
+// Package returns the package called name, with the import path
+// importPath, made up of the collected declarations.
+func (d *pkgDecls) Package(name, importPath string) *Package {
+	d.resolveDotImports(name)
+	foreign := d.foreignEmbeds(name)
+
+	structs := getStructs(d.methods, d.fields, d.embeds, foreign)
+	for _, st := range structs {
+		st.Doc = d.typeDocs[st.Name]
+		st.TypeParams = d.typeParams[st.Name]
+		renameTypeParams(st)
+	}
+
+	sort.Strings(d.typeNames)
+	return &Package{
+		ImportPath: importPath,
+		Name:       name,
+		Structs:    structs,
+		Functions:  d.funcs,
+		TypeNames:  d.typeNames,
+		Imports:    d.imports,
+		Warnings:   d.warnings,
+		Deprecated: d.deprecated,
+	}
+}
+
+// getFunctions returns the exported functions declared in astFile,
+// calling warn with those that are skipped.
+func getFunctions(astFile *ast.File, src []byte, warn func(error)) []*Function {
+	var funcs []*Function
+
+	for _, decl := range astFile.Decls {
+		if _, fd := receiverTypeName(src, decl); fd == nil {
+			if fd, ok := decl.(*ast.FuncDecl); ok {
+				if fd.Name != nil && ast.IsExported(fd.Name.Name) {
+					if fd.Type.TypeParams != nil {
+						warn(&UnsupportedTypeError{
+							Member: astFile.Name.Name + "." +
+								fd.Name.Name,
+							Reason: "generic functions are not " +
+								"supported",
+						})
+						continue
+					}
+
+					params := nameParams(getMethodFields(src,
+						fd.Type.Params.List))
+					results := []*Field{}
+					if fd.Type.Results != nil {
+						results = getMethodFields(src,
+							fd.Type.Results.List)
+					}
+					funcs = append(funcs, &Function{
+						Name:    fd.Name.Name,
+						Params:  params,
+						Results: results,
+					})
+				}
+			}
+		}
+	}
+
+	return funcs
+}
+
+// getTypeNames returns the names of all the exported types declared
+// at the top level of astFile.
+func getTypeNames(astFile *ast.File) []string {
+	var names []string
+	for _, decl := range astFile.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.IsExported() {
+				names = append(names, ts.Name.Name)
+			}
+		}
+	}
+	return names
+}
+
+// getTypeDocs returns the text of the doc comment of each exported type
+// in astFile that has one. A type alone in its declaration is documented
+// by the declaration's doc comment.
+func getTypeDocs(astFile *ast.File) map[string]string {
+	docs := make(map[string]string)
+	for _, decl := range astFile.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			doc := ts.Doc
+			if doc == nil && len(gd.Specs) == 1 {
+				doc = gd.Doc
+			}
+			if ts.Name.IsExported() && doc != nil {
+				docs[ts.Name.Name] = doc.Text()
+			}
+		}
+	}
+	return docs
+}
+
+// getDeprecated returns the exported structs, fields, methods and
+// functions in astFile whose doc comments say they're deprecated, as
+// for Package.Deprecated. src is the file's source, which may be nil as
+// for typeSource.
+func getDeprecated(astFile *ast.File, src []byte) []string {
+	var deprecated []string
+	for _, decl := range astFile.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if !isDeprecated(decl.Doc) {
+				continue
+			}
+			name := decl.Name.Name
+			if recv, fd := receiverTypeName(src, decl); fd != nil {
+				name = receiverBaseName(recv) + "." + name
+			}
+			deprecated = append(deprecated, name)
+		case *ast.GenDecl:
+			if decl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				ts := spec.(*ast.TypeSpec)
+				doc := ts.Doc
+				if doc == nil && len(decl.Specs) == 1 {
+					doc = decl.Doc
+				}
+				if isDeprecated(doc) {
+					deprecated = append(deprecated, ts.Name.Name)
+				}
+				st, ok := ts.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+				for _, field := range st.Fields.List {
+					if !isDeprecated(field.Doc) {
+						continue
+					}
+					for _, name := range field.Names {
+						deprecated = append(deprecated,
+							ts.Name.Name+"."+name.Name)
+					}
+				}
+			}
+		}
+	}
+	return deprecated
+}
+
+// isDeprecated reports whether doc has a paragraph starting with
+// Deprecated:, the convention for marking deprecated identifiers.
+func isDeprecated(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, line := range strings.Split(doc.Text(), "\n") {
+		if strings.HasPrefix(line, "Deprecated:") {
+			return true
+		}
+	}
+	return false
+}
+
+// getImports maps the names astFile refers to the packages it imports
+// by to their import paths. Blank and dot imports are left out as no
+// types are referred to by them.
+func getImports(astFile *ast.File) map[string]string {
+	imports := make(map[string]string)
+	for _, spec := range astFile.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := importName(importPath)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		if name == "_" || name == "." {
+			continue
+		}
+		imports[name] = importPath
+	}
+	return imports
+}
+
+// getDotImports returns the import paths of the packages astFile dot
+// imports.
+func getDotImports(astFile *ast.File) []string {
+	var dots []string
+	for _, spec := range astFile.Imports {
+		if spec.Name == nil || spec.Name.Name != "." {
+			continue
+		}
+		if importPath, err := strconv.Unquote(spec.Path.Value); err == nil {
+			dots = append(dots, importPath)
+		}
+	}
+	return dots
+}
+
+// importName guesses the name of the package with the given import
+// path, in the same way goimports does, e.g. yaml for gopkg.in/yaml.v2.
+func importName(importPath string) string {
+	base := path.Base(importPath)
+	if strings.HasPrefix(base, "v") {
+		if _, err := strconv.Atoi(base[1:]); err == nil {
+			if dir := path.Dir(importPath); dir != "." {
+				base = path.Base(dir)
+			}
+		}
+	}
+	base = strings.TrimPrefix(base, "go-")
+	if i := strings.IndexFunc(base, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}); i >= 0 {
+		base = base[:i]
+	}
+	return base
+}
+
+// getTypeParams returns the type parameters of the exported types
+// declared at the top level of astFile that have them, keyed by the
+// types' names.
+func getTypeParams(astFile *ast.File, src []byte) map[string][]*Field {
+	params := make(map[string][]*Field)
+	for _, decl := range astFile.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.IsExported() && ts.TypeParams != nil {
+				params[ts.Name.Name] = getMethodFields(src,
+					ts.TypeParams.List)
+			}
+		}
+	}
+	return params
+}
+
+// renameTypeParams renames the type parameters in the signatures of the
+// methods of the generic struct st to the names st declares them with,
+// as a method's receiver can name them differently.
+func renameTypeParams(st *Struct) {
+	for _, method := range st.Methods {
+		rename := make(map[string]string)
+		for i, name := range method.RecvTypeParams {
+			if i < len(st.TypeParams) && name != "_" &&
+				name != st.TypeParams[i].Name {
+				rename[name] = st.TypeParams[i].Name
+			}
+		}
+		if len(rename) == 0 {
+			continue
+		}
+		for _, fields := range [][]*Field{method.Params, method.Results} {
+			for _, field := range fields {
+				field.Type = rewriteType(field.Type, func(ident *ast.Ident) ast.Expr {
+					if name, ok := rename[ident.Name]; ok {
+						return ast.NewIdent(name)
+					}
+					return ident
+				})
+			}
+		}
+	}
+}
+
+// typeParamNames returns the names of the type parameters params.
+func typeParamNames(params []*Field) map[string]bool {
+	names := make(map[string]bool)
+	for _, param := range params {
+		names[param.Name] = true
+	}
+	return names
+}
+
+// getStructs builds the exported structs of a package from the methods,
+// fields and embedded types collected for each of them. foreign holds
+// the methods of the embedded foreign types, as for foreignEmbeds.
+func getStructs(methods map[string][]*Method, fields map[string][]*Field, embeds map[string][]string, foreign map[string]*Struct) []*Struct {
+	// structMap holds the unexported structs too, as they can promote
+	// methods to the exported ones, but only those are returned.
+	structMap := make(map[string]*Struct)
+
+	for st, stmethods := range methods {
+		structMap[st] = &Struct{
+			Name:    st,
+			Methods: stmethods,
+		}
+	}
+
+	for stName, stfields := range fields {
+		st, ok := structMap[stName]
+		if !ok {
+			st = &Struct{
+				Name:   stName,
+				Fields: stfields,
+			}
+		} else {
+			st.Fields = stfields
+		}
+		st.Embeds = embeds[stName]
+		structMap[stName] = st
+	}
+
+	promoted := make(map[string][]*Method)
+	for stName, st := range structMap {
+		promoted[stName] = promotedMethods(structMap, foreign, st)
+	}
+	for stName, methods := range promoted {
+		structMap[stName].Methods = append(structMap[stName].Methods,
+			methods...)
+	}
+
+	structs := make([]*Struct, 0)
+	for _, st := range structMap {
+		if ast.IsExported(st.Name) {
+			structs = append(structs, st)
+		}
+	}
+	// The structs are sorted so that the generated code doesn't change
+	// from one run to the next.
+	sort.Slice(structs, func(i, j int) bool {
+		return structs[i].Name < structs[j].Name
+	})
+
+	return structs
+}
+
+// promotedMethods returns the methods promoted to st from the local
+// structs it embeds, however deeply they are embedded, and from the
+// foreign types they embed. Methods that are shadowed by a shallower
+// field or method, or that are ambiguous because they are promoted from
+// two types at the same depth, are left out as Go does.
+func promotedMethods(structs, foreign map[string]*Struct, st *Struct) []*Method {
+	seen := make(map[string]bool)
+	for _, method := range st.Methods {
+		seen[method.Name] = true
+	}
+	for _, field := range st.Fields {
+		seen[field.Name] = true
+	}
+
+	var promoted []*Method
+	visited := map[string]bool{st.Name: true}
+	level := st.Embeds
+	for len(level) > 0 {
+		var next []string
+		found := make(map[string][]*Method)
+		// The methods are promoted in the order they're found so that
+		// the generated code doesn't change from one run to the next.
+		var order []string
+		for _, name := range level {
+			// The embedded field is named after the type, without
+			// its package.
+			seen[name[strings.LastIndex(name, ".")+1:]] = true
+			embedded, ok := structs[name]
+			if !ok {
+				embedded, ok = foreign[name]
+			}
+			if !ok || visited[name] {
+				continue
+			}
+			visited[name] = true
+			for _, method := range embedded.Methods {
+				if _, ok := found[method.Name]; !ok {
+					order = append(order, method.Name)
+				}
+				found[method.Name] = append(found[method.Name], method)
+			}
+			next = append(next, embedded.Embeds...)
+		}
+
+		for _, name := range order {
+			methods := found[name]
+			if !seen[name] && len(methods) == 1 {
+				promoted = append(promoted, methods[0])
+			}
+			seen[name] = true
+		}
+		level = next
+	}
+
+	return promoted
+}
+
+// exportableFields returns the fields of the struct st, of the package
+// pkg, whose type can be named outside of the package, calling warn
+// with those that can't.
+func exportableFields(pkg string, st *Struct, warn func(error)) []*Field {
+	var exportable []*Field
+	typeParams := typeParamNames(st.TypeParams)
+	for _, field := range st.Fields {
+		if typ := unexportedType(field.Type, typeParams); typ != "" {
+			warn(&UnexportedDependencyError{
+				Member: pkg + "." + st.Name + "." + field.Name,
+				Type:   typ,
+			})
+			continue
+		}
+		exportable = append(exportable, field)
+	}
+	return exportable
+}
+
+// exportableMethods returns the methods of the struct st, of the
+// package pkg, whose signature can be named outside of the package,
+// calling warn with those that can't.
+func exportableMethods(pkg string, st *Struct, warn func(error)) []*Method {
+	var exportable []*Method
+	typeParams := typeParamNames(st.TypeParams)
+	for _, method := range st.Methods {
+		if typ := signatureUnexportedType(method.Params, method.Results,
+			typeParams); typ != "" {
+			warn(&UnexportedDependencyError{
+				Member: pkg + "." + st.Name + "." + method.Name,
+				Type:   typ,
+			})
+			continue
+		}
+		exportable = append(exportable, method)
+	}
+	return exportable
+}
+
+// excludeMethods returns the methods of the struct st that don't match
+// any of the patterns in exclude. A pattern is either a method name,
+// matching the method of every struct, or <Struct>.<Method>.
+func excludeMethods(st string, methods []*Method, exclude []string) []*Method {
+	if len(exclude) == 0 {
+		return methods
+	}
+	excluded := make(map[string]bool)
+	for _, pattern := range exclude {
+		excluded[strings.TrimSpace(pattern)] = true
+	}
+
+	var kept []*Method
+	for _, method := range methods {
+		if excluded[method.Name] || excluded[st+"."+method.Name] {
+			continue
+		}
+		kept = append(kept, method)
+	}
+	return kept
+}
+
+// skipDeprecated removes pkg's deprecated structs and functions, and
+// the deprecated fields and methods of the rest.
+func skipDeprecated(pkg *Package) {
+	var structs []*Struct
+	for _, st := range pkg.Structs {
+		if pkg.Deprecated[st.Name] {
+			continue
+		}
+		var fields []*Field
+		for _, field := range st.Fields {
+			if !pkg.Deprecated[st.Name+"."+field.Name] {
+				fields = append(fields, field)
+			}
+		}
+		st.Fields = fields
+		var methods []*Method
+		for _, method := range st.Methods {
+			if !pkg.Deprecated[st.Name+"."+method.Name] {
+				methods = append(methods, method)
+			}
+		}
+		st.Methods = methods
+		structs = append(structs, st)
+	}
+	pkg.Structs = structs
+
+	var funcs []*Function
+	for _, fn := range pkg.Functions {
+		if !pkg.Deprecated[fn.Name] {
+			funcs = append(funcs, fn)
+		}
+	}
+	pkg.Functions = funcs
+}
+
+// wellKnownMethods are the methods of common standard library
+// interfaces, mapped to the interface and signature they have in it.
+var wellKnownMethods = map[string][2]string{
+	"Error":    {"error", "() string"},
+	"String":   {"fmt.Stringer", "() string"},
+	"GoString": {"fmt.GoStringer", "() string"},
+	"Read":     {"io.Reader", "([]byte) (int, error)"},
+	"Write":    {"io.Writer", "([]byte) (int, error)"},
+	"Close":    {"io.Closer", "() error"},
+	"Len":      {"sort.Interface", "() int"},
+	"Less":     {"sort.Interface", "(int, int) bool"},
+	"Swap":     {"sort.Interface", "(int, int)"},
+}
+
+// warnWellKnown warns about st's accessors and methods that have the
+// name of a method of a common interface but a different signature, as
+// the wrapper will look like it implements the interface but won't.
+func warnWellKnown(pkg string, st *Struct, warn func(error)) {
+	check := func(name string, params, results []*Field) {
+		known, ok := wellKnownMethods[name]
+		if !ok {
+			return
+		}
+		if sig := signature(params, results); sig != known[1] {
+			warn(fmt.Errorf("%s.%s.%s%s doesn't have the signature of "+
+				"%s's %s%s", pkg, st.Name, name, sig, known[0], name,
+				known[1]))
+		}
+	}
+
+	for _, field := range st.Fields {
+		check(field.Getter, nil, []*Field{{Type: field.Type}})
+	}
+	for _, method := range st.Methods {
+		check(method.Name, method.Params, method.Results)
+	}
+}
+
+// signature renders the types of params and results as a signature,
+// e.g. ([]byte) (int, error).
+func signature(params, results []*Field) string {
+	list := func(fields []*Field) string {
+		var typs []string
+		for _, field := range fields {
+			// Printing the parsed type normalises its spacing.
+			typ := field.Type
+			if expr, err := parseType(typ); err == nil {
+				typ = types.ExprString(expr)
+			}
+			typs = append(typs, typ)
+		}
+		return strings.Join(typs, ", ")
+	}
+
+	sig := "(" + list(params) + ")"
+	switch {
+	case len(results) == 1:
+		sig += " " + list(results)
+	case len(results) > 1:
+		sig += " (" + list(results) + ")"
+	}
+	return sig
+}
+
+// limitMethods returns the structs that have at most max methods,
+// calling warn with the others. If max is 0 there is no limit.
+func limitMethods(pkg string, structs []*Struct, max int, warn func(error)) []*Struct {
+	if max <= 0 {
+		return structs
+	}
+	var limited []*Struct
+	for _, st := range structs {
+		if len(st.Methods) > max {
+			warn(&UnsupportedTypeError{
+				Member: pkg + "." + st.Name,
+				Reason: fmt.Sprintf("it has %d methods, more than the "+
+					"maximum of %d", len(st.Methods), max),
+			})
+			continue
+		}
+		limited = append(limited, st)
+	}
+	return limited
+}
+
+// exportableFunctions returns the functions of the package pkg whose
+// signature can be named outside of it, calling warn with those that
+// can't.
+func exportableFunctions(pkg string, funcs []*Function, warn func(error)) []*Function {
+	var exportable []*Function
+	for _, fn := range funcs {
+		if typ := signatureUnexportedType(fn.Params, fn.Results, nil); typ != "" {
+			warn(&UnexportedDependencyError{
+				Member: pkg + "." + fn.Name,
+				Type:   typ,
+			})
+			continue
+		}
+		exportable = append(exportable, fn)
+	}
+	return exportable
+}
+
+// signatureUnexportedType returns the first unexported local type
+// referenced by a signature's params or results, or "" if there is
+// none. The names in typeParams are type parameters rather than types.
+func signatureUnexportedType(params, results []*Field, typeParams map[string]bool) string {
+	for _, fields := range [][]*Field{params, results} {
+		for _, field := range fields {
+			if typ := unexportedType(field.Type, typeParams); typ != "" {
+				return typ
+			}
+		}
+	}
+	return ""
+}
+
+// setGetters names the accessor of each of st's fields, prefix<Field>.
+// An accessor that would collide with one of st's methods, or another
+// accessor, is renamed to Get<Field>, or <Field> if that's the name that
+// collided, and dropped if that collides too, calling warn either way.
+func setGetters(pkg string, st *Struct, prefix string, warn func(error)) {
+	taken := make(map[string]bool)
+	for _, method := range st.Methods {
+		taken[method.Name] = true
+	}
+
+	var fields []*Field
+	for _, field := range st.Fields {
+		getter := prefix + field.Name
+		if taken[getter] {
+			fallback := "Get" + field.Name
+			if fallback == getter {
+				fallback = field.Name
+			}
+			member := pkg + "." + st.Name + "." + field.Name
+			if taken[fallback] {
+				warn(&UnsupportedTypeError{
+					Member: member,
+					Reason: fmt.Sprintf("its accessors %s and %s are "+
+						"already taken", getter, fallback),
+				})
+				continue
+			}
+			warn(fmt.Errorf("%s: accessor collides with method %s, "+
+				"using %s", member, getter, fallback))
+			getter = fallback
+		}
+		taken[getter] = true
+		field.Getter = getter
+		fields = append(fields, field)
+	}
+	st.Fields = fields
+}
+
+// getMethods returns the exported methods declared in astFile, keyed by
+// the name of their receiver type, calling warn with those that are
+// skipped.
+func getMethods(astFile *ast.File, src []byte, warn func(error)) map[string][]*Method {
+	methodMap := make(map[string][]*Method)
+	for _, decl := range astFile.Decls {
+		a, fd := receiverTypeName(src, decl)
+		a = receiverBaseName(a)
+
+		if fd != nil && ast.IsExported(fd.Name.Name) {
+			// Go doesn't allow methods to have type parameters and
+			// interfaces couldn't declare them anyway.
+			if fd.Type.TypeParams != nil {
+				warn(&UnsupportedTypeError{
+					Member: astFile.Name.Name + "." + a + "." +
+						fd.Name.Name,
+					Reason: "methods can't have type parameters",
+				})
+				continue
+			}
+
+			methods, ok := methodMap[a]
+			if !ok {
+				methods = make([]*Method, 0)
+			}
+
+			// As per the docs, fd.Type.Params
+			// cannot be nil but fd.Type.Results
+			// can be
+			params := nameParams(getMethodFields(src,
+				fd.Type.Params.List))
+			results := []*Field{}
+			if fd.Type.Results != nil {
+				results = getMethodFields(src, fd.Type.Results.List)
+			}
+			recv := fd.Recv.List[0].Type
+			star, pointerRecv := recv.(*ast.StarExpr)
+			if pointerRecv {
+				recv = star.X
+			}
+			var recvTypeParams []string
+			switch recv := recv.(type) {
+			case *ast.IndexExpr:
+				recvTypeParams = []string{types.ExprString(recv.Index)}
+			case *ast.IndexListExpr:
+				for _, index := range recv.Indices {
+					recvTypeParams = append(recvTypeParams,
+						types.ExprString(index))
+				}
+			}
+			methods = append(methods, &Method{
+				Name:           fd.Name.Name,
+				Params:         params,
+				Results:        results,
+				ValueRecv:      !pointerRecv,
+				RecvTypeParams: recvTypeParams,
+			})
+			methodMap[a] = methods
+		}
+	}
+
+	return methodMap
+}
+
+// receiverBaseName returns the name of the receiver type name without
+// the type parameters of a generic receiver, e.g. List for List[T], so
+// that all of a type's methods are grouped together.
+func receiverBaseName(name string) string {
+	if i := strings.Index(name, "["); i >= 0 {
+		return strings.TrimSpace(name[:i])
+	}
+	return name
+}
+
+// typeSource returns the source of the type expression typ from the
+// file with the source src. If src is nil, as when only the file's AST
+// is available, the source is printed from typ instead. Every file is
+// parsed into a FileSet of its own, whose base is 1, so a position less
+// one is its byte offset in src. //line directives only change the
+// file names and lines positions are reported with, not the positions
+// themselves.
+func typeSource(src []byte, typ ast.Expr) string {
+	if src == nil {
+		return types.ExprString(typ)
+	}
+	return string(src[typ.Pos()-1 : typ.End()-1])
+}
+
+// receiverTypeName returns the name of the receiver type of decl and
+// decl itself if it's a method. Otherwise it returns "" and nil. src is
+// the source of decl's file, which may be nil as for typeSource.
+func receiverTypeName(src []byte, decl ast.Decl) (string, *ast.FuncDecl) {
+	if src != nil {
+		return maker.GetReceiverTypeName(src, decl)
+	}
+	fd, ok := decl.(*ast.FuncDecl)
+	if !ok || fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return "", nil
+	}
+	return strings.TrimPrefix(types.ExprString(fd.Recv.List[0].Type), "*"), fd
+}
+
+// getMethodFields returns a field for each of the params or results in
+// astFields. Fields sharing a type, as in (a, b int), are split up so
+// that every name is kept, giving a int, b int.
+func getMethodFields(src []byte, astFields []*ast.Field) []*Field {
+	var fields []*Field
+
+	for _, astField := range astFields {
+		typ := typeSource(src, astField.Type)
+		if len(astField.Names) == 0 {
+			fields = append(fields, &Field{Type: typ})
+			continue
+		}
+		for _, name := range astField.Names {
+			fields = append(fields, &Field{Name: name.Name, Type: typ})
+		}
+	}
+
+	return fields
+}
+
+// nameParams gives every unnamed or blank parameter in params a name so
+// that it can be forwarded.
+func nameParams(params []*Field) []*Field {
+	for i, param := range params {
+		if param.Name == "" || param.Name == "_" {
+			param.Name = fmt.Sprintf("p%d", i)
+		}
+	}
+	return params
+}
+
+// getFields returns the exported fields of each struct in astFile, along
+// with the types each struct embeds as for Struct.Embeds. Unexported
+// structs are included as they can promote methods to exported ones.
+func getFields(astFile *ast.File, src []byte) (map[string][]*Field, map[string][]string) {
+	fieldMap := make(map[string][]*Field)
+	embedMap := make(map[string][]string)
+
+	// Only structs declared at the top level can be wrapped, so struct
+	// types nested in functions or other types are ignored.
+	for _, decl := range astFile.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+
+			var exportedFields []*Field
+			var embeds []string
+			for _, astField := range st.Fields.List {
+				if len(astField.Names) == 0 {
+					if name := embeddedName(astField.Type); name != "" {
+						embeds = append(embeds, name)
+					}
+					continue
+				}
+				for _, name := range astField.Names {
+					// Blank fields, such as no-copy guards and
+					// padding, can never be accessed.
+					if name.Name == "_" || !name.IsExported() {
+						continue
+					}
+
+					field := &Field{}
+					field.Name = name.Name
+					field.Type = typeSource(src, astField.Type)
+
+					exportedFields = append(exportedFields, field)
+				}
 			}
-			return list
-		},
+			fieldMap[ts.Name.Name] = exportedFields
+			embedMap[ts.Name.Name] = embeds
+		}
+	}
+	return fieldMap, embedMap
+}
+
+// embeddedName returns the type embedded by an embedded field of type
+// typ as for Struct.Embeds, or "" if it's neither a local type nor a
+// foreign one.
+func embeddedName(typ ast.Expr) string {
+	if star, ok := typ.(*ast.StarExpr); ok {
+		if sel, ok := star.X.(*ast.SelectorExpr); ok {
+			return "*" + types.ExprString(sel)
+		}
+		typ = star.X
+	}
+	switch typ := typ.(type) {
+	case *ast.Ident:
+		return typ.Name
+	case *ast.SelectorExpr:
+		return types.ExprString(typ)
+	}
+	return ""
+}
+
+// buildIfaces builds an interface for each of pkg's structs, using m
+// to map their types. If mk is set, it is embedded in every interface.
+// If provenance is set, each method is commented with the member it
+// wraps.
+func buildIfaces(pkg *Package, m *typeMapper, mk *marker, provenance bool) ([]string, error) {
+	var ifaces []string
+
+	iface := `type {{ ifaceName .Name }}{{ typeParams .TypeParams }} interface {
+{{- with .Marker }}
+    {{ . }}
+{{- end }}
+{{- range $field := .Fields }}
+{{- if $.Provenance }}
+    // {{ $field.Getter }} returns {{ $.Pkg }}.{{ $.Name }}.{{ $field.Name }}.
+{{- end }}
+    {{ $field.Getter }}() {{ ifaceType $field.Type }}
+{{- end }}
+{{- range $method := .Methods }}
+{{- if and $.Provenance $method.Stub }}
+    // {{ $method.Name }} is added, {{ $.Pkg }}.{{ $.Name }} has no such method.
+{{- else if $.Provenance }}
+    // {{ $method.Name }} wraps {{ $.Pkg }}.{{ $.Name }}.{{ $method.Name }}.
+{{- end }}
+    {{ $method.Name }}({{ toList $method.Params }}){{ with results $method.Results }} {{ . }}{{ end }}
+{{- end }}
+}`
+
+	ifaceTmpl, err := template.New("iface").Funcs(template.FuncMap{
+		"toList":     m.fieldList,
+		"results":    m.resultList,
+		"ifaceType":  m.ifaceType,
+		"typeParams": m.typeParamList,
+		"ifaceName":  m.ifaceTypeName,
 	}).Parse(iface)
 	if err != nil {
 		return []string{}, err
 	}
 
+	defer m.setTypeParams(nil)
 	for _, st := range pkg.Structs {
+		m.setTypeParams(st.TypeParams)
+		if err := mk.check(m.ifaceTypeName(st.Name), structMethods(st),
+			m); err != nil {
+			return []string{}, err
+		}
 		buf := new(bytes.Buffer)
-		err := ifaceTmpl.Execute(buf, st)
+		err := ifaceTmpl.Execute(buf, struct {
+			*Struct
+			Pkg        string
+			Marker     string
+			Provenance bool
+		}{
+			Struct:     st,
+			Pkg:        pkg.Name,
+			Marker:     mk.String(),
+			Provenance: provenance,
+		})
 		if err != nil {
 			return []string{}, err
 		}
@@ -534,104 +2826,441 @@ type {{.Name}} interface {
 	return ifaces, nil
 }
 
-func buildImpls(pkg *Package) ([]string, error) {
-	var impls []string
+// structMethods returns the methods of the interface of st, its field
+// accessors followed by its methods.
+func structMethods(st *Struct) []*Method {
+	var methods []*Method
+	for _, field := range st.Fields {
+		methods = append(methods, &Method{
+			Name:    field.Getter,
+			Results: []*Field{{Type: field.Type}},
+		})
+	}
+	return append(methods, st.Methods...)
+}
+
+// funcMethods returns the methods of the interface grouping pkg's
+// functions.
+func funcMethods(pkg *Package) []*Method {
+	var methods []*Method
+	for _, fn := range pkg.Functions {
+		methods = append(methods, &Method{
+			Name:    fn.Name,
+			Params:  fn.Params,
+			Results: fn.Results,
+		})
+	}
+	return methods
+}
 
-	impl := `
-type {{ .StructName }} struct {
-    parent *{{ .PkgName }}.{{ .StructName }}
+// lowerFirst returns name with its first letter in lower case, e.g. for
+// an unexported type named after an exported one.
+func lowerFirst(name string) string {
+	return strings.ToLower(name[:1]) + name[1:]
 }
 
-{{ range $field := .Fields }}
-func (x *{{$.StructName}}){{ $field.Name }}() ({{ maybeAddIfacePkg $field.Type }}) {
-    return x.parent.{{$field.Name}}
+// methodNames returns the set of the names of methods.
+func methodNames(methods []*Method) map[string]bool {
+	names := make(map[string]bool)
+	for _, method := range methods {
+		names[method.Name] = true
+	}
+	return names
 }
-{{ end }}
 
-{{ range $method := .Methods }}
-func (x *{{$.StructName}}) {{.Name}}({{toList $method.Params}}) ({{toList $method.Results}}) {
-    return x.parent.{{$method.Name}}({{argList $method.Params}})
+// checkIfaceNames checks that the interfaces generated for pkg, named
+// as opts says, have different names, warning if the functions
+// interface had to be renamed.
+func checkIfaceNames(pkg *Package, opts Options) error {
+	names := make(map[string]string)
+	for _, st := range pkg.Structs {
+		names[opts.IfaceNamePrefix+st.Name+opts.IfaceNameSuffix] = st.Name
+	}
+	if len(pkg.Functions) == 0 {
+		return nil
+	}
+	name := funcsIfaceName(pkg)
+	if base := funcsIfaceBase(pkg); name != base {
+		opts.warn(fmt.Errorf("package %s already declares %s or "+
+			"Default%s, using %s for its functions interface", pkg.Name,
+			base, base, name))
+	}
+	funcs := opts.IfaceNamePrefix + name + opts.IfaceNameSuffix
+	if st, ok := names[funcs]; ok {
+		return fmt.Errorf("the interfaces of %s.%s and of its functions "+
+			"would both be called %s", pkg.Name, st, funcs)
+	}
+	return nil
 }
-{{ end }}
-`
 
-	toList := func(fields []*Field) string {
-		var list string
-		prefix := ""
-		for _, field := range fields {
-			typ := maybeAddIfacePkg(pkg, field.Type)
-			list += prefix + field.Name + " " + typ
-			prefix = ", "
+// funcsIfaceName returns the name of the interface grouping pkg's
+// functions. It is normally <Pkg>Funcs but a number is appended if
+// that, or the name of its default, Default<Pkg>Funcs, would collide
+// with one of pkg's exported identifiers.
+func funcsIfaceName(pkg *Package) string {
+	taken := make(map[string]bool)
+	for _, name := range pkg.TypeNames {
+		taken[name] = true
+	}
+	for _, fn := range pkg.Functions {
+		taken[fn.Name] = true
+	}
+
+	base := funcsIfaceBase(pkg)
+	name := base
+	for i := 2; taken[name] || taken["Default"+name]; i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	return name
+}
+
+// funcsIfaceBase returns the name the interface grouping pkg's
+// functions has unless it collides, <Pkg>Funcs.
+func funcsIfaceBase(pkg *Package) string {
+	return strings.ToUpper(pkg.Name[:1]) + pkg.Name[1:] + "Funcs"
+}
+
+// buildFuncsIface builds an interface grouping all of pkg's exported
+// functions, using m to map their types. If pkg has no exported
+// functions it returns "". If mk is set, it is embedded in the
+// interface. If provenance is set, each method is commented with the
+// function it wraps.
+func buildFuncsIface(pkg *Package, m *typeMapper, mk *marker, provenance bool) (string, error) {
+	if len(pkg.Functions) == 0 {
+		return "", nil
+	}
+	name := m.ifaceTypeName(funcsIfaceName(pkg))
+	if err := mk.check(name, funcMethods(pkg), m); err != nil {
+		return "", err
+	}
+
+	iface := `type {{ .Name }} interface {
+{{- with .Marker }}
+    {{ . }}
+{{- end }}
+{{- range $fn := .Functions }}
+{{- if $.Provenance }}
+    // {{ $fn.Name }} wraps {{ $.Pkg }}.{{ $fn.Name }}.
+{{- end }}
+    {{ $fn.Name }}({{ toList $fn.Params }}){{ with results $fn.Results }} {{ . }}{{ end }}
+{{- end }}
+}`
+
+	ifaceTmpl, err := template.New("funcs").Funcs(template.FuncMap{
+		"toList":  m.fieldList,
+		"results": m.resultList,
+	}).Parse(iface)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	err = ifaceTmpl.Execute(buf, struct {
+		Name       string
+		Pkg        string
+		Marker     string
+		Provenance bool
+		Functions  []*Function
+	}{
+		Name:       name,
+		Pkg:        pkg.Name,
+		Marker:     mk.String(),
+		Provenance: provenance,
+		Functions:  pkg.Functions,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// constructorName returns the name of the function constructing the
+// wrapper of pkg's struct st. It is New<Struct> unless pkg declares a
+// type or function of that name, in which case it is Wrap<Struct>.
+func constructorName(pkg *Package, st string) string {
+	if pkgDeclares(pkg, "New"+st) {
+		return "Wrap" + st
+	}
+	return "New" + st
+}
+
+// pkgDeclares reports whether pkg declares an exported type or function
+// called name.
+func pkgDeclares(pkg *Package, name string) bool {
+	for _, typ := range pkg.TypeNames {
+		if typ == name {
+			return true
+		}
+	}
+	for _, fn := range pkg.Functions {
+		if fn.Name == name {
+			return true
 		}
-		return list
 	}
+	return false
+}
 
-	argList := func(fields []*Field) string {
-		var args string
-		prefix := ""
-		for _, field := range fields {
-			args += prefix + field.Name
-			prefix = ", "
+// checkImplNames checks that the names declared by the wrapper package
+// of pkg, the wrappers of its structs and functions, their
+// constructors and helpers and the default of the functions interface,
+// are all different.
+func checkImplNames(pkg *Package) error {
+	names := make(map[string]string)
+	declare := func(name, what string) error {
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("%s and %s would both be called %s in "+
+				"the wrappers of package %s", other, what, name, pkg.Name)
+		}
+		names[name] = what
+		return nil
+	}
+
+	for _, fn := range pkg.Functions {
+		if err := declare(fn.Name, "the wrapper of "+pkg.Name+"."+
+			fn.Name); err != nil {
+			return err
+		}
+	}
+	for _, st := range pkg.Structs {
+		of := " of " + pkg.Name + "." + st.Name
+		for _, decl := range [][2]string{
+			{st.Name, "the wrapper" + of},
+			{constructorName(pkg, st.Name), "the constructor" + of},
+			{"wrap" + st.Name, "the wrap helper" + of},
+			{"unwrap" + st.Name, "the unwrap helper" + of},
+		} {
+			if err := declare(decl[0], decl[1]); err != nil {
+				return err
+			}
+		}
+	}
+	if len(pkg.Functions) == 0 {
+		return nil
+	}
+	name := funcsIfaceName(pkg)
+	of := " of " + pkg.Name + "'s functions interface"
+	for _, decl := range [][2]string{
+		{lowerFirst(name), "the implementation" + of},
+		{"Default" + name, "the default" + of},
+		{constructorName(pkg, name), "the constructor" + of},
+	} {
+		if err := declare(decl[0], decl[1]); err != nil {
+			return err
 		}
-		return args
 	}
+	return nil
+}
+
+// buildImpls builds a wrapper struct for each of pkg's structs that
+// forwards to the wrapped struct, stored in the field opts.ParentField.
+// m is used to map the types of the wrappers' methods. The wrappers'
+// methods have pointer receivers unless opts.MirrorReceivers is set, in
+// which case they have the same kind of receivers as the methods they
+// forward to and field accessors have value receivers. If
+// opts.SafeForward is set, the wrappers' methods check they have a
+// parent before forwarding to it. The wrappers are given the methods of
+// mk, if it's set, that they don't have.
+func buildImpls(pkg *Package, m *typeMapper, opts Options, mk *marker) ([]string, error) {
+	var impls []string
+
+	impl := `{{ with .Doc }}{{ comment . }}
+{{ end -}}
+type {{ .StructName }}{{ .TypeParams }} struct {
+    {{ .Parent }} *{{ .PkgName }}.{{ .Type }}
+}
+
+{{ if .TypeParams -}}
+func _{{ .TypeParams }}() {
+    var _ {{ .Iface }} = (*{{ .Type }})(nil)
+}
+{{- else -}}
+var _ {{ .Iface }} = (*{{ .Type }})(nil)
+{{- end }}
+
+func {{ .Constructor }}{{ .TypeParams }}({{ .Parent }} *{{ .PkgName }}.{{ .Type }}) *{{ .Type }} {
+    return &{{ .Type }}{ {{- .Parent }}: {{ .Parent -}} }
+}
+
+// wrap{{ .StructName }} wraps p, keeping nil pointers nil.
+func wrap{{ .StructName }}{{ .TypeParams }}(p *{{ .PkgName }}.{{ .Type }}) {{ .Iface }} {
+    if p == nil {
+        return nil
+    }
+    return {{ .Constructor }}(p)
+}
+
+// unwrap{{ .StructName }} returns the struct wrapped by w, which must
+// have been created by {{ .Constructor }}.
+func unwrap{{ .StructName }}{{ .TypeParams }}(w {{ .Iface }}) *{{ .PkgName }}.{{ .Type }} {
+    if w == nil {
+        return nil
+    }
+    return w.(*{{ .Type }}).{{ .Parent }}
+}
+{{- if .SafeForward }}
+
+// checkParent panics, naming method, if {{ .Recv }} wasn't created by
+// {{ .Constructor }} and so has no struct to forward to.
+func ({{ .Recv }} *{{ .Type }}) checkParent(method string) {
+    if {{ .Recv }} == nil || {{ .Recv }}.{{ .Parent }} == nil {
+        panic("{{ .Wrapped }}." + method + " called on a " +
+            "wrapper with no wrapped struct, create it with {{ .Constructor }}")
+    }
+}
+{{- end }}
+{{- range $field := .Fields }}
+
+{{ if isStructValue $field.Type -}}
+// {{ $field.Getter }} wraps a copy of the {{ $field.Name }} field, so changes made
+// through it don't affect the wrapped struct.
+{{ end -}}
+func ({{ $.Recv }} {{ if not $.MirrorRecvs }}*{{ end }}{{ $.Type }}) {{ $field.Getter }}() {{ ifaceType $field.Type }} {
+    {{- if $.SafeForward }}
+    {{ $.Recv }}.checkParent("{{ $field.Getter }}")
+    {{- end }}
+    {{ forwardField (printf "%s.%s.%s" $.Recv $.Parent $field.Name) $field.Type }}
+}
+{{- end }}
+{{- range $method := .Methods }}
+
+func ({{ $.Recv }} {{ if not (and $.MirrorRecvs $method.ValueRecv) }}*{{ end }}{{ $.Type }}) {{.Name}}({{toList $method.Params}}){{with results $method.Results}} {{.}}{{end}} {
+    {{- if $method.Stub }}
+    // TODO implement
+    panic("{{ $.Wrapped }} has no {{ $method.Name }} method to forward to")
+    {{- else }}
+    {{- if $.SafeForward }}
+    {{ $.Recv }}.checkParent("{{ $method.Name }}")
+    {{- end }}
+    {{ forward (printf "%s.%s.%s" $.Recv $.Parent $method.Name) $method.Params $method.Results }}
+    {{- end }}
+}
+{{- end }}`
 
 	implTempl, err := template.New("impl").Funcs(template.FuncMap{
-		"toList":  toList,
-		"argList": argList,
-		"maybeAddIfacePkg": func(typ string) string {
-			return maybeAddIfacePkg(pkg, typ)
-		},
+		"toList":        m.fieldList,
+		"results":       m.resultList,
+		"ifaceType":     m.ifaceType,
+		"forward":       m.forward,
+		"forwardField":  m.forwardField,
+		"isStructValue": m.isStructValue,
+		"comment":       comment,
 	}).Parse(impl)
 	if err != nil {
 		return []string{}, err
 	}
 
+	defer m.setTypeParams(nil)
 	for _, st := range pkg.Structs {
+		m.setTypeParams(st.TypeParams)
+		typeArgs := typeArgList(st.TypeParams)
+		methods := m.unshadowMethods(st.Methods)
 		buf := new(bytes.Buffer)
 		err := implTempl.Execute(buf, struct {
-			PkgName    string
-			StructName string
-			Fields     []*Field
-			Methods    []*Method
+			PkgName     string
+			Wrapped     string
+			StructName  string
+			TypeParams  string
+			Type        string
+			Doc         string
+			Iface       string
+			Constructor string
+			Recv        string
+			Parent      string
+			Fields      []*Field
+			Methods     []*Method
+			MirrorRecvs bool
+			SafeForward bool
 		}{
-			PkgName:    pkg.Name,
-			StructName: st.Name,
-			Fields:     st.Fields,
-			Methods:    st.Methods,
+			PkgName:     m.pkgName,
+			Wrapped:     pkg.Name + "." + st.Name,
+			StructName:  st.Name,
+			TypeParams:  m.typeParamList(st.TypeParams),
+			Type:        st.Name + typeArgs,
+			Doc:         st.Doc,
+			Iface:       m.ifaceType(st.Name) + typeArgs,
+			Constructor: constructorName(pkg, st.Name),
+			Recv:        receiverName("x", methods),
+			Parent:      opts.ParentField,
+			Fields:      st.Fields,
+			Methods:     methods,
+			MirrorRecvs: opts.MirrorReceivers,
+			SafeForward: opts.SafeForward,
 		})
 		if err != nil {
 			return []string{}, err
 		}
 		impls = append(impls, buf.String())
+		impls = append(impls, mk.stubs(st.Name+typeArgs,
+			methodNames(structMethods(st)), m)...)
 	}
 
 	return impls, nil
 }
 
-func pkgContainsType(pkg *Package, typ string) bool {
-	for _, st := range pkg.Structs {
-		if st.Name == typ {
-			return true
+// receiverName returns a name for the receiver of a type with the given
+// methods that none of their parameters or results shadow, recv
+// repeated as many times as needed.
+func receiverName(recv string, methods []*Method) string {
+	used := make(map[string]bool)
+	for _, method := range methods {
+		for _, field := range namedResults(method.Results) {
+			used[field.Name] = true
+		}
+		for _, field := range method.Params {
+			used[field.Name] = true
 		}
 	}
-	return false
-}
 
-func maybeAddIfacePkg(pkg *Package, typ string) string {
-	isPtr := false
-	if typ[0] == '*' {
-		isPtr = true
-		typ = typ[1:]
+	name := recv
+	for used[name] {
+		name += recv
 	}
+	return name
+}
 
-	if pkgContainsType(pkg, typ) {
-		typ = pkg.Name + "iface." + typ
+// shadowsPackage reports whether a name declared by the generated
+// wrappers for pkg, such as a parameter or a variable holding a
+// converted value, could shadow pkg's name.
+func shadowsPackage(pkg *Package) bool {
+	declared := map[string]bool{
+		// The variables declared by typeMapper.convert and the
+		// parameters of the wrap and unwrap functions.
+		"v": true, "c": true, "e": true, "i": true, "k": true, "p": true,
+		"w": true,
 	}
-
-	if isPtr {
-		typ = "*" + typ
+	declare := func(fields []*Field) {
+		for _, field := range fields {
+			declared[field.Name] = true
+		}
+	}
+	for _, st := range pkg.Structs {
+		declared[receiverName("x", st.Methods)] = true
+		for _, method := range st.Methods {
+			declare(method.Params)
+			declare(method.Results)
+		}
 	}
+	for _, fn := range pkg.Functions {
+		declare(fn.Params)
+		declare(fn.Results)
+	}
+	if declared[pkg.Name] {
+		return true
+	}
+
+	// Converted params and results are held in p0, p1, ... and r0,
+	// r1, ..., rr0, ...
+	prefix := strings.TrimRight(pkg.Name, "0123456789")
+	return prefix != pkg.Name &&
+		(prefix == "p" || prefix != "" && strings.Trim(prefix, "r") == "")
+}
 
-	return typ
+func pkgContainsType(pkg *Package, typ string) bool {
+	for _, st := range pkg.Structs {
+		if st.Name == typ {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,2614 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// outPkg is the import path the tests generate packages under.
+const outPkg = "example.com/out"
+
+// testGopath writes pkgs, mapping import paths to the names and sources
+// of their files, to a temporary GOPATH that's used for the rest of the
+// test, and returns it.
+func testGopath(t testing.TB, pkgs map[string]map[string]string) string {
+	t.Helper()
+	gopath := t.TempDir()
+	for importPath, files := range pkgs {
+		dir := filepath.Join(gopath, "src", importPath)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, src := range files {
+			err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Setenv("GOPATH", gopath)
+	t.Setenv("GO111MODULE", "off")
+	// The source importer, used to load other packages' types, reads
+	// GOPATH from the default build context, which is set up at
+	// start.
+	defaultGopath := build.Default.GOPATH
+	build.Default.GOPATH = gopath
+	t.Cleanup(func() { build.Default.GOPATH = defaultGopath })
+	return gopath
+}
+
+// The files generated for the package example.com/foo by
+// testGenerateFoo.
+const (
+	fooIface = outPkg + "/fooiface/fooiface.go"
+	fooImpl  = outPkg + "/foo/foo.go"
+	fooFakes = outPkg + "/foofakes/foofakes.go"
+)
+
+// testGenerateFoo generates the packages for example.com/foo, made up
+// of the file foo.go with the source src, with the options set changes,
+// if it isn't nil. It fails the test if the generated code doesn't
+// compile, and returns it as testGenerate does.
+func testGenerateFoo(t *testing.T, src string, set func(*Options)) map[string]string {
+	t.Helper()
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": src},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	if set != nil {
+		set(&opts)
+	}
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+	return files
+}
+
+// testContains fails the test if src, the generated file name, doesn't
+// contain each of wants.
+func testContains(t *testing.T, name, src string, wants ...string) {
+	t.Helper()
+	for _, want := range wants {
+		if !strings.Contains(src, want) {
+			t.Errorf("%s doesn't contain %q:\n%s", name, want, src)
+		}
+	}
+}
+
+// testOptions returns the options generating the package input under
+// outPkg in gopath.
+func testOptions(gopath, input string) Options {
+	return Options{
+		Input:   input,
+		Output:  filepath.Join(gopath, "src", outPkg),
+		BasePkg: outPkg,
+	}
+}
+
+// testGenerate generates the files opts describe, failing the test if
+// it fails, and returns their sources by their paths relative to the
+// GOPATH's src directory, e.g. example.com/out/foo/foo.go.
+func testGenerate(t *testing.T, opts Options) map[string]string {
+	t.Helper()
+	files, err := Generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testFiles(t, files)
+}
+
+// testFiles returns the sources of files by their paths relative to the
+// GOPATH's src directory.
+func testFiles(t *testing.T, files []GeneratedFile) map[string]string {
+	t.Helper()
+	srcs := make(map[string]string)
+	for _, file := range files {
+		rel := file.Path
+		if i := strings.Index(rel, "/src/"); i >= 0 {
+			rel = rel[i+len("/src/"):]
+		}
+		srcs[rel] = string(file.Source)
+	}
+	return srcs
+}
+
+// testVet writes files, as returned by testGenerate, to gopath and vets
+// them, failing the test if they don't compile.
+func testVet(t *testing.T, gopath string, files map[string]string) {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("vetting the generated code needs the go tool")
+	}
+
+	var pkgs []string
+	for rel, src := range files {
+		fileName := filepath.Join(gopath, "src", rel)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fileName, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pkgs = append(pkgs, filepath.Dir(rel))
+	}
+
+	cmd := exec.Command(goTool, append([]string{"vet"}, pkgs...)...)
+	cmd.Dir = gopath
+	cmd.Env = append(os.Environ(), "GOPATH="+gopath, "GO111MODULE=off",
+		"GOFLAGS=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("vetting the generated code: %v\n%s", err, out)
+	}
+}
+
+// testRun writes files, as returned by testGenerate, to gopath along
+// with a main package with the source main, and returns what it prints
+// when it's run, failing the test if it doesn't compile or fails.
+func testRun(t *testing.T, gopath string, files map[string]string, main string) string {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("running the generated code needs the go tool")
+	}
+
+	withMain := map[string]string{outPkg + "/cmd/main.go": main}
+	for rel, src := range files {
+		withMain[rel] = src
+	}
+	testVet(t, gopath, withMain)
+
+	cmd := exec.Command(goTool, "run", outPkg+"/cmd")
+	cmd.Dir = gopath
+	cmd.Env = append(os.Environ(), "GOPATH="+gopath, "GO111MODULE=off",
+		"GOFLAGS=")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("running the generated code: %v\n%s", err, out)
+	}
+	return string(out)
+}
+
+func TestDotImports(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+import . "strings"
+
+type Stack[T any] struct{ items []T }
+
+func (s *Stack[T]) Push(v T)            {}
+func (s *Stack[E]) Builder(e E) *Builder { return nil }
+
+type Pair[K comparable, V any] struct {
+	Key K
+	Val V
+}
+
+func (p *Pair[K, V]) Reader(k K) *Reader { return nil }
+`},
+	})
+
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+	testVet(t, gopath, files)
+
+	iface := files["example.com/out/fooiface/fooiface.go"]
+	for _, want := range []string{
+		"Push(v T)", "Builder(e T) *strings.Builder", "Key() K",
+		"Reader(k K) *strings.Reader",
+	} {
+		if !strings.Contains(iface, want) {
+			t.Errorf("the interfaces have no %s:\n%s", want, iface)
+		}
+	}
+	if strings.Contains(iface, "strings.T") || strings.Contains(iface, "strings.K") {
+		t.Errorf("a type parameter is qualified as dot-imported:\n%s", iface)
+	}
+}
+
+func TestMainPackage(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/cmd": {"main.go": `package main
+
+type Server struct{}
+
+func (s *Server) Run() {}
+
+func main() {}
+`},
+		"example.com/foo": {
+			"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`,
+			"gen.go": `//go:build ignore
+
+package main
+
+func main() {}
+`,
+		},
+	})
+
+	_, err := Generate(testOptions(gopath, "example.com/cmd"))
+	if want := "example.com/cmd is a main package"; err == nil ||
+		!strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want one containing %q", err, want)
+	}
+	var usage usageError
+	if !errors.As(err, &usage) {
+		t.Errorf("got error %T, want a usageError", err)
+	}
+
+	// A generator next to a library is left out rather than failing
+	// the run.
+	opts := testOptions(gopath, "example.com/foo")
+	var warnings []error
+	opts.Warn = func(err error) { warnings = append(warnings, err) }
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+	if _, ok := files["example.com/out/fooiface/fooiface.go"]; !ok {
+		t.Errorf("no interfaces were generated for foo: %v", files)
+	}
+	for rel := range files {
+		if strings.Contains(rel, "main") {
+			t.Errorf("%s was generated for the main package", rel)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(),
+		"package main") {
+		t.Errorf("got warnings %v, want one about package main", warnings)
+	}
+}
+
+func TestBuildTagVariants(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {
+			"foo.go": "package foo\n\ntype S struct{}\n",
+			"foo_linux.go": `package foo
+
+func (s S) Foo() string { return "linux" }
+
+func Open() *S { return nil }
+`,
+			"foo_windows.go": `package foo
+
+func (s S) Foo() string { return "windows" }
+
+func Open() *S { return nil }
+`,
+		},
+		"example.com/bar": {
+			"bar.go": "package bar\n\ntype S struct{}\n",
+			"bar_linux.go": `package bar
+
+func (s S) Foo() {}
+`,
+			"bar_windows.go": `package bar
+
+func (s *S) Foo() {}
+`,
+		},
+	})
+
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+	testVet(t, gopath, files)
+	iface := files["example.com/out/fooiface/fooiface.go"]
+	if n := strings.Count(iface, "Foo() string"); n != 1 {
+		t.Errorf("Foo is in the interface %d times, want once:\n%s", n, iface)
+	}
+
+	_, err := Generate(testOptions(gopath, "example.com/bar"))
+	var conflict *ReceiverConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("got error %v, want a ReceiverConflictError", err)
+	}
+	if conflict.Method != "bar.S.Foo" ||
+		!strings.HasSuffix(conflict.ValueFile, "bar_linux.go") ||
+		!strings.HasSuffix(conflict.PointerFile, "bar_windows.go") {
+		t.Errorf("got conflict %+v", conflict)
+	}
+}
+
+// testStdout returns what f prints to stdout.
+func testStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	f()
+	w.Close()
+	return string(<-out)
+}
+
+func TestGetterPrefix(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Counter struct {
+	Count int
+	Name  string
+}
+
+func (c *Counter) GetCount() int { return c.Count }
+`},
+	})
+
+	for prefix, want := range map[string][]string{
+		"":      {"Count() int", "Name() string", "GetCount() int"},
+		"Get":   {"Count() int", "GetName() string", "GetCount() int"},
+		"Fetch": {"FetchCount() int", "FetchName() string", "GetCount() int"},
+	} {
+		opts := testOptions(gopath, "example.com/foo")
+		opts.GetterPrefix = prefix
+		files := testGenerate(t, opts)
+		testVet(t, gopath, files)
+
+		iface := files["example.com/out/fooiface/fooiface.go"]
+		for _, method := range want {
+			if !strings.Contains(iface, "\t"+method+"\n") {
+				t.Errorf("prefix %q: the interface has no %s:\n%s",
+					prefix, method, iface)
+			}
+		}
+	}
+}
+
+func TestInternalPackage(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/app/internal/store": {"store.go": `package store
+
+import "example.com/app/internal/model"
+
+type Kind int
+
+type Store struct{}
+
+func (s *Store) Get(k Kind) model.User { return model.User{} }
+`},
+		"example.com/app/internal/model": {"model.go": `package model
+
+type User struct{ Name string }
+`},
+	})
+
+	outside := testOptions(gopath, "example.com/app/internal/store")
+	outside.GenFakes = true
+	var warnings []error
+	outside.Warn = func(err error) { warnings = append(warnings, err) }
+	testGenerate(t, outside)
+
+	want := map[string]bool{
+		"example.com/out/storeiface example.com/app/internal/store": true,
+		"example.com/out/storeiface example.com/app/internal/model": true,
+		"example.com/out/store example.com/app/internal/store":      true,
+		"example.com/out/store example.com/app/internal/model":      true,
+		"example.com/out/storefakes example.com/app/internal/store": true,
+		"example.com/out/storefakes example.com/app/internal/model": true,
+	}
+	for _, warning := range warnings {
+		var internal *InternalImportError
+		if !errors.As(warning, &internal) {
+			t.Errorf("unexpected warning %v", warning)
+			continue
+		}
+		key := internal.Importer + " " + internal.Package
+		if !want[key] {
+			t.Errorf("unexpected warning %v", warning)
+		}
+		delete(want, key)
+	}
+	for key := range want {
+		t.Errorf("no warning that %s can't be imported", key)
+	}
+
+	// Under the internal package's parent, the generated packages can
+	// import it.
+	inside := testOptions(gopath, "example.com/app/internal/store")
+	inside.Output = filepath.Join(gopath, "src", "example.com", "app",
+		"testable")
+	inside.BasePkg = "example.com/app/testable"
+	inside.GenFakes = true
+	inside.Warn = func(err error) { t.Errorf("unexpected warning %v", err) }
+	testVet(t, gopath, testGenerate(t, inside))
+}
+
+func TestGenerateContextCancelled(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	files, err := GenerateContext(ctx, opts)
+	if err != context.Canceled || files != nil {
+		t.Errorf("got %d files and error %v, want none and %v",
+			len(files), err, context.Canceled)
+	}
+
+	err = run(opts, time.Nanosecond, writeFiles)
+	if err == nil || !strings.Contains(err.Error(), "generation timed out") {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	if _, err := os.Stat(opts.Output); !os.IsNotExist(err) {
+		t.Errorf("the timed out run wrote %s", opts.Output)
+	}
+}
+
+func TestTimeoutWhileParsing(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": "package foo\n\ntype Client struct{}\n"},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+
+	// The parse hangs until the test is over. parseFile is only
+	// restored once the hook has been called, so the generation left
+	// running has already read it.
+	called, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	defer func(f func(*token.FileSet, string, interface{}, parser.Mode) (*ast.File, error)) {
+		<-called
+		parseFile = f
+	}(parseFile)
+	parseFile = func(*token.FileSet, string, interface{}, parser.Mode) (*ast.File, error) {
+		called <- struct{}{}
+		<-release
+		return nil, errors.New("released")
+	}
+
+	start := time.Now()
+	err := run(opts, 50*time.Millisecond, writeFiles)
+	if err == nil || !strings.Contains(err.Error(), "generation timed out") {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %s to time out after 50ms", elapsed)
+	}
+	if _, err := os.Stat(opts.Output); !os.IsNotExist(err) {
+		t.Errorf("the timed out run wrote %s", opts.Output)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	const client = "package foo\n\ntype Client struct{}\n"
+	for _, tt := range []struct {
+		name string
+		src  string
+		set  func(opts *Options)
+		mode outputMode
+		code int
+	}{
+		{
+			name: "usage",
+			src:  client,
+			set:  func(opts *Options) { opts.BuildTag = "linux &&" },
+			code: exitUsage,
+		},
+		{
+			name: "parse",
+			src:  "package foo\n\ntype Client struct {\n",
+			code: exitParse,
+		},
+		{
+			name: "generate",
+			src: client + "\nfunc NewClient() *Client { return nil }\n" +
+				"\nfunc WrapClient() *Client { return nil }\n",
+			code: exitGenerate,
+		},
+		{
+			name: "write",
+			src:  client,
+			set: func(opts *Options) {
+				// The output is under a file, so can't be created.
+				if err := os.WriteFile(opts.Output, nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				opts.Output = filepath.Join(opts.Output, "out")
+			},
+			code: exitWrite,
+		},
+		{
+			name: "stale",
+			src:  client,
+			mode: checkFiles,
+			code: exitStale,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gopath := testGopath(t, map[string]map[string]string{
+				"example.com/foo": {"foo.go": tt.src},
+			})
+			opts := testOptions(gopath, "example.com/foo")
+			if tt.set != nil {
+				tt.set(&opts)
+			}
+			err := run(opts, 0, tt.mode)
+			if err == nil {
+				t.Fatal("run succeeded")
+			}
+			if code := exitCode(err); code != tt.code {
+				t.Errorf("got exit code %d for %v, want %d", code, err,
+					tt.code)
+			}
+		})
+	}
+}
+
+func TestPostProcessError(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": "package foo\n\ntype Client struct{}\n"},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+
+	// Only the implementation fails, so the interface would be written
+	// if files were written as they're processed.
+	errFormat := errors.New("formatter failed")
+	opts.PostProcess = func(file GeneratedFile) (GeneratedFile, error) {
+		if strings.HasSuffix(file.Path, fooImpl) {
+			return file, errFormat
+		}
+		return file, nil
+	}
+
+	err := run(opts, 0, writeFiles)
+	if !errors.Is(err, errFormat) {
+		t.Errorf("got error %v, want %v", err, errFormat)
+	}
+	if _, err := os.Stat(opts.Output); !os.IsNotExist(err) {
+		t.Errorf("the failed run wrote %s", opts.Output)
+	}
+}
+
+func TestBuildTag(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+
+	opts := testOptions(gopath, "example.com/foo")
+	opts.BuildTag = "mocks"
+	files, err := Generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxt := build.Default
+	for _, file := range files {
+		want := "//go:build mocks\n// +build mocks\n\n" + generatedHeader
+		if !strings.HasPrefix(string(file.Source), want) {
+			t.Errorf("%s doesn't start with the constraint:\n%s",
+				file.Path, file.Source)
+		}
+
+		// The constraint is above the package clause, so it's applied.
+		ctxt.OpenFile = func(string) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(file.Source)), nil
+		}
+		ctxt.BuildTags = nil
+		if match, err := ctxt.MatchFile(filepath.Split(file.Path)); err != nil || match {
+			t.Errorf("%s is built without the tag: %v", file.Path, err)
+		}
+		ctxt.BuildTags = []string{"mocks"}
+		if match, err := ctxt.MatchFile(filepath.Split(file.Path)); err != nil || !match {
+			t.Errorf("%s isn't built with the tag: %v", file.Path, err)
+		}
+	}
+
+	opts.BuildTag = "not a tag"
+	var usage usageError
+	if _, err := Generate(opts); !errors.As(err, &usage) {
+		t.Errorf("got error %v for an invalid build tag, want a usageError",
+			err)
+	}
+}
+
+func TestFuncsIfaceNameCollision(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type FooFuncs struct{ N int }
+
+func New() *FooFuncs { return nil }
+`, nil)
+
+	testContains(t, fooIface, files[fooIface],
+		"type FooFuncs interface {\n\tN() int\n}",
+		"type FooFuncs2 interface {\n\tNew() FooFuncs\n}")
+	testContains(t, fooImpl, files[fooImpl],
+		"var DefaultFooFuncs2 fooiface.FooFuncs2 = fooFuncs2{}",
+		"func NewFooFuncs2() fooiface.FooFuncs2 {")
+}
+
+func TestGeneratedNameCollisions(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type Server struct{}
+
+type NewServer struct{}
+
+func DefaultFooFuncs() {}
+`, nil)
+
+	testContains(t, fooImpl, files[fooImpl],
+		"func WrapServer(parent *foo.Server) *Server {",
+		"func NewNewServer(parent *foo.NewServer) *NewServer {",
+		"var DefaultFooFuncs2 fooiface.FooFuncs2 = fooFuncs2{}",
+		"func DefaultFooFuncs() {")
+
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func NewClient() *Client { return nil }
+
+func WrapClient(c *Client) *Client { return c }
+`},
+	})
+	_, err := Generate(testOptions(gopath, "example.com/foo"))
+	if err == nil || !strings.Contains(err.Error(), "the wrapper of "+
+		"foo.WrapClient and the constructor of foo.Client would both be "+
+		"called WrapClient") {
+		t.Errorf("got error %v, want the constructor colliding", err)
+	}
+}
+
+func TestEmbeddedPointerPromotedMethods(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+import "errors"
+
+type Base struct{}
+
+func (b *Base) Ping() error { return errors.New("pong") }
+
+type Server struct {
+	*Base
+	Addr string
+}
+
+func (s *Server) Serve() {}
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	testContains(t, fooIface, files[fooIface],
+		"type Server interface {\n\tAddr() string\n\tServe()\n\tPing() error\n}")
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	srcfoo "example.com/foo"
+	"example.com/out/foo"
+	"example.com/out/fooiface"
+)
+
+func main() {
+	var s fooiface.Server = foo.NewServer(&srcfoo.Server{Base: &srcfoo.Base{}})
+	fmt.Println(s.Ping())
+}
+`)
+	if out != "pong\n" {
+		t.Errorf("the promoted method returned %q, want pong", out)
+	}
+}
+
+func TestNoExportedTypes(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type client struct{ n int }
+
+func (c *client) Get() int { return c.n }
+
+func newClient() *client { return nil }
+`},
+	})
+
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	files, err := Generate(testOptions(gopath, "example.com/foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("got files %v, want none", testFiles(t, files))
+	}
+	if want := "package foo: no exported types to wrap, skipping"; !strings.Contains(logs.String(), want) {
+		t.Errorf("got logs %q, want %q", logs, want)
+	}
+}
+
+func TestFieldAccessorCollidesWithMethod(t *testing.T) {
+	// Go doesn't allow a field and a method with the same name, but
+	// testable only parses the source, so it still has to generate
+	// something that compiles if the source doesn't.
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Counter struct {
+	Value int
+}
+
+func (c *Counter) Value() int { return 0 }
+`},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	var warnings []error
+	opts.Warn = func(err error) { warnings = append(warnings, err) }
+	files := testGenerate(t, opts)
+
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(),
+		"foo.Counter.Value: accessor collides with method Value, "+
+			"using GetValue") {
+		t.Errorf("got warnings %v, want one renaming the Value accessor",
+			warnings)
+	}
+
+	testContains(t, fooIface, files[fooIface],
+		"type Counter interface {\n\tGetValue() int\n\tValue() int\n}")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *Counter) GetValue() int {\n\treturn x.parent.Value\n}",
+		"func (x *Counter) Value() int {\n\treturn x.parent.Value()\n}")
+}
+
+func TestNestedStructs(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type Config struct {
+	Server struct {
+		Addr string
+	}
+	Name string
+}
+
+func (c *Config) Load() error {
+	type state struct{ Done bool }
+	return nil
+}
+
+func Open() *Config {
+	var tmp struct{ Path string }
+	_ = tmp
+	return nil
+}
+`, nil)
+
+	iface := files[fooIface]
+	if n := strings.Count(iface, " interface {"); n != 2 {
+		t.Errorf("got %d interfaces, want Config's and FooFuncs:\n%s",
+			n, iface)
+	}
+	testContains(t, fooIface, iface,
+		"type Config interface {\n\tServer() struct{ Addr string }\n")
+}
+
+func TestBlankFields(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type Point struct {
+	_    struct{}
+	X, _ int
+	Y    int
+}
+`, nil)
+
+	testContains(t, fooIface, files[fooIface],
+		"type Point interface {\n\tX() int\n\tY() int\n}")
+}
+
+func TestUnexportedResult(t *testing.T) {
+	var warnings []error
+	files := testGenerateFoo(t, `package foo
+
+type state struct{ n int }
+
+type Server struct{}
+
+func (s *Server) State() *state { return nil }
+
+func (s *Server) Addr() string { return "" }
+`, func(opts *Options) {
+		opts.Warn = func(err error) { warnings = append(warnings, err) }
+	})
+
+	testContains(t, fooIface, files[fooIface],
+		"type Server interface {\n\tAddr() string\n}")
+	var unexported *UnexportedDependencyError
+	if len(warnings) != 1 || !errors.As(warnings[0], &unexported) {
+		t.Fatalf("got warnings %v, want an UnexportedDependencyError",
+			warnings)
+	}
+	if unexported.Member != "foo.Server.State" || unexported.Type != "state" {
+		t.Errorf("got warning %+v", unexported)
+	}
+}
+
+func TestUnexportedArrayLength(t *testing.T) {
+	var warnings []error
+	files := testGenerateFoo(t, `package foo
+
+const size = 4
+
+const Size = 2 * size
+
+type Digest struct {
+	Sum  [size]byte
+	Full [Size]byte
+}
+
+func Hash(b []byte) [size + 1]byte { return [size + 1]byte{} }
+
+func Pad(b [(Size)]byte) {}
+`, func(opts *Options) {
+		opts.Warn = func(err error) { warnings = append(warnings, err) }
+	})
+
+	testContains(t, fooIface, files[fooIface],
+		"type Digest interface {\n\tFull() [foo.Size]byte\n}",
+		"\tPad(b [(foo.Size)]byte)\n")
+	want := map[string]bool{"foo.Digest.Sum": true, "foo.Hash": true}
+	for _, warning := range warnings {
+		var unexported *UnexportedDependencyError
+		if !errors.As(warning, &unexported) || !want[unexported.Member] ||
+			unexported.Type != "size" {
+			t.Errorf("unexpected warning %v", warning)
+		}
+		delete(want, unexported.Member)
+	}
+	for member := range want {
+		t.Errorf("%s isn't skipped", member)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	dir := filepath.Join(gopath, "src", "example.com", "foo")
+	opts := testOptions(gopath, "example.com/foo")
+	opts.Overlay = map[string][]byte{
+		filepath.Join(dir, "foo.go"): []byte(`package foo
+
+type Client struct{}
+
+func (c *Client) Put(v string) {}
+`),
+		// A file that's only in the overlay, e.g. a new unsaved buffer.
+		filepath.Join(dir, "server.go"): []byte(`package foo
+
+type Server struct{}
+
+func (s *Server) Serve() {}
+`),
+	}
+	files := testGenerate(t, opts)
+
+	testContains(t, fooIface, files[fooIface],
+		"type Client interface {\n\tPut(v string)\n}",
+		"type Server interface {\n\tServe()\n}")
+	if strings.Contains(files[fooIface], "Get()") {
+		t.Errorf("the interfaces have the method on disk:\n%s",
+			files[fooIface])
+	}
+}
+
+// testLargePackage returns a package example.com/large of files files,
+// each declaring structs structs with a field and a few methods.
+func testLargePackage(files, structs int) map[string]map[string]string {
+	srcs := make(map[string]string)
+	for i := 0; i < files; i++ {
+		src := new(strings.Builder)
+		fmt.Fprintf(src, "package large\n")
+		for j := 0; j < structs; j++ {
+			name := fmt.Sprintf("S%d_%d", i, j)
+			fmt.Fprintf(src, `
+// %[1]s is a struct.
+type %[1]s struct{ Name string }
+
+// Get gets.
+func (s *%[1]s) Get(key string) (*%[1]s, error) { return s, nil }
+
+// Put puts.
+func (s *%[1]s) Put(key string, values ...*%[1]s) {}
+
+// Len is the length.
+func (s *%[1]s) Len() int { return len(s.Name) }
+`, name)
+		}
+		srcs[fmt.Sprintf("file%d.go", i)] = src.String()
+	}
+	return map[string]map[string]string{"example.com/large": srcs}
+}
+
+func BenchmarkReadPackage(b *testing.B) {
+	testGopath(b, testLargePackage(50, 40))
+	dir := pkgDir("example.com/large")
+
+	// liveHeap reports the heap in use once the package has been read,
+	// which is dominated by the sources and ASTs that are still held.
+	liveHeap := func(b *testing.B, read func() interface{}) {
+		b.ReportAllocs()
+		var live uint64
+		for i := 0; i < b.N; i++ {
+			held := read()
+			runtime.GC()
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			live += stats.HeapInuse
+			runtime.KeepAlive(held)
+		}
+		b.ReportMetric(float64(live)/float64(b.N), "live-B/op")
+	}
+
+	// Parsing the whole directory at once, as was done before files
+	// were read one at a time, holds every file's AST.
+	b.Run("ParseDir", func(b *testing.B) {
+		liveHeap(b, func() interface{} {
+			pkgs, err := parser.ParseDir(token.NewFileSet(), dir, nil,
+				parser.ParseComments)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return pkgs
+		})
+	})
+	b.Run("OneFileAtATime", func(b *testing.B) {
+		liveHeap(b, func() interface{} {
+			pkgs, err := getSubpackages(context.Background(),
+				"example.com/large", nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return pkgs
+		})
+	})
+}
+
+func TestNoResults(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type Server struct{}
+
+func (s *Server) Stop() {}
+
+func (s *Server) Close(force bool) {}
+`, nil)
+
+	testContains(t, fooIface, files[fooIface],
+		"type Server interface {\n\tStop()\n\tClose(force bool)\n}")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *Server) Stop() {\n\tx.parent.Stop()\n}",
+		"func (x *Server) Close(force bool) {\n\tx.parent.Close(force)\n}")
+	if strings.Contains(files[fooIface]+files[fooImpl], ") ()") {
+		t.Errorf("a method without results has empty parens")
+	}
+}
+
+func TestFacade(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type UserService struct{}
+
+func (s *UserService) User(id int) string { return "" }
+
+type OrderService struct{}
+
+func (s OrderService) Order(id int) string { return "" }
+
+type API struct {
+	*UserService
+	OrderService
+}
+`, nil)
+
+	testContains(t, fooIface, files[fooIface],
+		"type API interface {\n\tUser(id int) string\n\tOrder(id int) string\n}")
+}
+
+func TestIfacesOnly(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`, func(opts *Options) { opts.IfacesOnly = true })
+
+	if _, ok := files[fooIface]; !ok || len(files) != 1 {
+		t.Errorf("got files %v, want only %s", files, fooIface)
+	}
+}
+
+func TestGenericReceiver(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type List[T any] struct{ items []T }
+
+func (l *List[T]) Len() int { return len(l.items) }
+
+func (l *List[E]) Push(v E) { l.items = append(l.items, v) }
+`, nil)
+
+	// The methods are grouped under List, whatever the receiver calls
+	// its type parameter.
+	testContains(t, fooIface, files[fooIface],
+		"type List[T any] interface {\n\tLen() int\n\tPush(v T)\n}")
+}
+
+func TestProvenanceComments(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type Client struct{ Addr string }
+
+func (c *Client) Get(key string) string { return "" }
+
+func Dial(addr string) *Client { return nil }
+`, func(opts *Options) { opts.ProvenanceComments = true })
+
+	testContains(t, fooIface, files[fooIface],
+		"\t// Addr returns foo.Client.Addr.\n\tAddr() string\n",
+		"\t// Get wraps foo.Client.Get.\n\tGet(key string) string\n",
+		"\t// Dial wraps foo.Dial.\n\tDial(addr string) Client\n")
+}
+
+func TestStandardInterfaces(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Name struct{ s string }
+
+func (n Name) String() string { return n.s }
+
+type Stream struct{}
+
+func (s *Stream) Read(p []byte) (int, error) { return copy(p, "data"), nil }
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+	"io"
+
+	srcfoo "example.com/foo"
+	"example.com/out/foo"
+	"example.com/out/fooiface"
+)
+
+// The wrappers and their interfaces satisfy the standard interfaces
+// the wrapped structs do.
+var (
+	_ fmt.Stringer = (*foo.Name)(nil)
+	_ fmt.Stringer = fooiface.Name(nil)
+	_ io.Reader    = (*foo.Stream)(nil)
+	_ io.Reader    = fooiface.Stream(nil)
+)
+
+func main() {
+	data, _ := io.ReadAll(io.LimitReader(foo.NewStream(&srcfoo.Stream{}), 4))
+	fmt.Println(foo.NewName(&srcfoo.Name{}), string(data))
+}
+`)
+	if out != " data\n" {
+		t.Errorf("got %q, want \" data\"", out)
+	}
+}
+
+func TestMaxMethods(t *testing.T) {
+	var warnings []error
+	files := testGenerateFoo(t, `package foo
+
+type God struct{}
+
+func (g *God) A() {}
+func (g *God) B() {}
+func (g *God) C() {}
+
+type Small struct{}
+
+func (s *Small) A() {}
+func (s *Small) B() {}
+`, func(opts *Options) {
+		opts.MaxMethods = 2
+		opts.Warn = func(err error) { warnings = append(warnings, err) }
+	})
+
+	if strings.Contains(files[fooIface], "God") {
+		t.Errorf("God is wrapped:\n%s", files[fooIface])
+	}
+	testContains(t, fooIface, files[fooIface], "type Small interface {")
+	var unsupported *UnsupportedTypeError
+	if len(warnings) != 1 || !errors.As(warnings[0], &unsupported) ||
+		unsupported.Member != "foo.God" {
+		t.Errorf("got warnings %v, want one skipping foo.God", warnings)
+	}
+}
+
+func TestJoinedErrors(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/multi": {
+			"a.go":    "package a\n\ntype A struct{}\n\nfunc (a *A) Get( {}\n",
+			"b.go":    "package b\n\ntype B struct{}\n\nfunc (b *B) Get() {\n",
+			"good.go": "package good\n\ntype C struct{}\n\nfunc (c *C) Get() {}\n",
+		},
+	})
+	opts := testOptions(gopath, "example.com/multi")
+	opts.ContinueOnError = true
+	files, err := Generate(opts)
+
+	if err == nil {
+		t.Fatal("got no error, want one for each broken package")
+	}
+	var failed []string
+	for _, line := range strings.Split(err.Error(), "\n") {
+		failed = append(failed, strings.SplitN(line, ":", 2)[0])
+	}
+	if got := strings.Join(failed, ", "); got != "package a, package b" {
+		t.Errorf("got errors for %s, want them for package a, package b:\n%v",
+			got, err)
+	}
+	var parse parseError
+	if !errors.As(err, &parse) {
+		t.Errorf("got error %T, want a parseError", err)
+	}
+	// The package that parses is still generated.
+	if _, ok := testFiles(t, files)[outPkg+"/goodiface/goodiface.go"]; !ok {
+		t.Errorf("good wasn't generated: %v", testFiles(t, files))
+	}
+}
+
+func TestExcludeMethods(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+func (c *Client) Close() error { return nil }
+func (c *Client) Reset()       {}
+
+type Server struct{}
+
+func (s *Server) Close() error { return nil }
+func (s *Server) Reset()       {}
+`, func(opts *Options) {
+		opts.ExcludeMethods = []string{"Client.Close", "Reset"}
+	})
+
+	testContains(t, fooIface, files[fooIface],
+		"type Client interface {\n\tGet() string\n}",
+		"type Server interface {\n\tClose() error\n}")
+	if strings.Contains(files[fooImpl], "Reset") ||
+		strings.Contains(files[fooImpl], "func (x *Client) Close") {
+		t.Errorf("the wrappers have excluded methods:\n%s", files[fooImpl])
+	}
+}
+
+func TestGroupedImports(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+import "io"
+
+type Client struct{}
+
+func (c *Client) Body() io.Reader { return nil }
+`, nil)
+
+	astFile, err := parser.ParseFile(token.NewFileSet(), fooImpl,
+		files[fooImpl], parser.ImportsOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(astFile.Decls) != 1 || !astFile.Decls[0].(*ast.GenDecl).Lparen.IsValid() {
+		t.Errorf("the imports aren't in a single group:\n%s", files[fooImpl])
+	}
+	if len(astFile.Imports) != 3 {
+		t.Errorf("got %d imports, want io, foo and fooiface", len(astFile.Imports))
+	}
+}
+
+func TestPackageDoc(t *testing.T) {
+	src := `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`
+	files := testGenerateFoo(t, src, func(opts *Options) { opts.GenFakes = true })
+	testContains(t, fooIface, files[fooIface], "\n// Package fooiface contains "+
+		"the generated interfaces of foo.\npackage fooiface\n")
+	testContains(t, fooImpl, files[fooImpl], "\n// Package foo contains the "+
+		"generated wrappers implementing the interfaces in fooiface.\n"+
+		"package foo\n")
+	testContains(t, fooFakes, files[fooFakes], "\n// Package foofakes "+
+		"contains the generated fakes of the interfaces in fooiface.\n"+
+		"package foofakes\n")
+
+	files = testGenerateFoo(t, src, func(opts *Options) {
+		opts.PackageDoc = "is generated, see gen.go."
+	})
+	testContains(t, fooIface, files[fooIface],
+		"\n// Package fooiface is generated, see gen.go.\npackage fooiface\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"\n// Package foo is generated, see gen.go.\npackage foo\n")
+}
+
+func TestNoParamsNoResults(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type S struct{}
+
+func (s *S) Foo() {}
+`, nil)
+
+	testContains(t, fooIface, files[fooIface], "type S interface {\n\tFoo()\n}")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *S) Foo() {\n\tx.parent.Foo()\n}")
+}
+
+func TestGenericMethod(t *testing.T) {
+	// Go doesn't allow methods with type parameters, but they parse.
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type S struct{}
+
+func (s *S) Do[T any](x T) {}
+
+func (s *S) Map(f func(int) int) {}
+`},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	var warnings []error
+	opts.Warn = func(err error) { warnings = append(warnings, err) }
+	files := testGenerate(t, opts)
+
+	testContains(t, fooIface, files[fooIface],
+		"type S interface {\n\tMap(f func(int) int)\n}")
+	var unsupported *UnsupportedTypeError
+	if len(warnings) != 1 || !errors.As(warnings[0], &unsupported) ||
+		unsupported.Member != "foo.S.Do" {
+		t.Errorf("got warnings %v, want one skipping foo.S.Do", warnings)
+	}
+}
+
+func TestGenerateFromAST(t *testing.T) {
+	// type Client struct{ Addr string }
+	// func (c *Client) Get(key string) (string, error)
+	id := ast.NewIdent
+	field := func(name string, typ ast.Expr) *ast.Field {
+		f := &ast.Field{Type: typ}
+		if name != "" {
+			f.Names = []*ast.Ident{id(name)}
+		}
+		return f
+	}
+	file := &ast.File{
+		Name: id("foo"),
+		Decls: []ast.Decl{
+			&ast.GenDecl{Tok: token.TYPE, Specs: []ast.Spec{&ast.TypeSpec{
+				Name: id("Client"),
+				Type: &ast.StructType{Fields: &ast.FieldList{
+					List: []*ast.Field{field("Addr", id("string"))},
+				}},
+			}}},
+			&ast.FuncDecl{
+				Recv: &ast.FieldList{List: []*ast.Field{
+					field("c", &ast.StarExpr{X: id("Client")}),
+				}},
+				Name: id("Get"),
+				Type: &ast.FuncType{
+					Params: &ast.FieldList{List: []*ast.Field{
+						field("key", id("string")),
+					}},
+					Results: &ast.FieldList{List: []*ast.Field{
+						field("", id("string")), field("", id("error")),
+					}},
+				},
+			},
+		},
+	}
+	pkg := &ast.Package{
+		Name:  "foo",
+		Files: map[string]*ast.File{"foo.go": file},
+	}
+
+	files, err := GenerateFromAST(pkg, "example.com/foo", outPkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcs := testFiles(t, files)
+	testContains(t, "fooiface", srcs["fooiface/fooiface.go"],
+		"type Client interface {\n\tAddr() string\n\tGet(key string) (string, error)\n}")
+	testContains(t, "foo", srcs["foo/foo.go"], "\t\"example.com/out/fooiface\"\n",
+		"func (x *Client) Get(key string) (string, error) {\n"+
+			"\treturn x.parent.Get(key)\n}")
+}
+
+func TestValueFieldCopy(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Point struct{ X, Y int }
+
+func (p *Point) Move(dx int) { p.X += dx }
+
+type Shape struct{ Position Point }
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	testContains(t, fooImpl, files[fooImpl],
+		"// Position wraps a copy of the Position field")
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	srcfoo "example.com/foo"
+	"example.com/out/foo"
+)
+
+func main() {
+	shape := &srcfoo.Shape{Position: srcfoo.Point{X: 1}}
+	pos := foo.NewShape(shape).Position()
+	pos.Move(10)
+	fmt.Println(pos.X(), shape.Position.X)
+}
+`)
+	if out != "11 1\n" {
+		t.Errorf("got %q, want the copy moved but not the parent's field", out)
+	}
+}
+
+func TestForcePointerReceivers(t *testing.T) {
+	src := `package foo
+
+type Name struct{ s string }
+
+func (n Name) String() string { return n.s }
+
+func (n *Name) Set(s string) { n.s = s }
+`
+	files := testGenerateFoo(t, src, nil)
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *Name) String() string {", "func (x *Name) Set(s string) {",
+		"var _ fooiface.Name = (*Name)(nil)")
+
+	// Without forcing them, value receivers are mirrored.
+	files = testGenerateFoo(t, src, func(opts *Options) {
+		opts.MirrorReceivers = true
+	})
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x Name) String() string {", "func (x *Name) Set(s string) {")
+}
+
+func TestRangeOverFunc(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+import "iter"
+
+type List struct{ items []string }
+
+func (l *List) All() iter.Seq2[int, string] {
+	return func(yield func(int, string) bool) {
+		for i, item := range l.items {
+			if !yield(i, item) {
+				return
+			}
+		}
+	}
+}
+
+func (l *List) Join(sep string) string {
+	var joined string
+	for i, item := range l.All() {
+		if i > 0 {
+			joined += sep
+		}
+		joined += item
+	}
+	for range 3 {
+	}
+	return joined
+}
+`, nil)
+
+	testContains(t, fooIface, files[fooIface], "\t\"iter\"\n",
+		"type List interface {\n\tAll() iter.Seq2[int, string]\n\tJoin(sep string) string\n}")
+}
+
+func TestEmbeddingWrapperSatisfiesEmbedded(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Base struct{ id string }
+
+func (b *Base) ID() string { return b.id }
+
+type Server struct {
+	*Base
+}
+
+func (s *Server) Serve() {}
+
+func New(id string) *Server { return &Server{Base: &Base{id: id}} }
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	testContains(t, fooImpl, files[fooImpl],
+		"var _ fooiface.Server = (*Server)(nil)")
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	"example.com/out/foo"
+	"example.com/out/fooiface"
+)
+
+// The wrapper of the embedding struct also satisfies the embedded
+// struct's interface.
+var _ fooiface.Base = (*foo.Server)(nil)
+
+func main() {
+	var base fooiface.Base = foo.New("s1")
+	fmt.Println(base.ID())
+}
+`)
+	if out != "s1\n" {
+		t.Errorf("got %q, want s1", out)
+	}
+}
+
+func TestSafeForward(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	opts.SafeForward = true
+	files := testGenerate(t, opts)
+
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	"example.com/out/foo"
+)
+
+func main() {
+	defer func() { fmt.Println(recover()) }()
+	var c foo.Client
+	c.Get()
+}
+`)
+	if want := "foo.Client.Get called on a wrapper with no wrapped " +
+		"struct, create it with NewClient\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestWellKnownMethodNames(t *testing.T) {
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	testGenerateFoo(t, `package foo
+
+type Result struct {
+	Error int
+	Name  string
+}
+
+func (r *Result) String() string { return r.Name }
+`, nil)
+
+	if want := "foo.Result.Error() int doesn't have the signature of " +
+		"error's Error() string"; !strings.Contains(logs.String(), want) {
+		t.Errorf("got logs %q, want %q", logs, want)
+	}
+	if strings.Count(logs.String(), "warning") != 1 {
+		t.Errorf("got logs %q, want a single warning", logs)
+	}
+}
+
+func TestTestHelperPackage(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/testutil": {
+			"testutil.go": `package testutil
+
+type Server struct{}
+
+func (s *Server) URL() string { return "" }
+`,
+			// Types declared in _test.go files can't be imported, so
+			// they aren't wrapped.
+			"testutil_test.go": `package testutil
+
+type Fixture struct{}
+
+func (f *Fixture) Load() {}
+`,
+		},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/testutil"))
+	testVet(t, gopath, files)
+
+	iface := files[outPkg+"/testutiliface/testutiliface.go"]
+	testContains(t, "testutiliface", iface, "type Server interface {\n\tURL() string\n}")
+	if strings.Contains(iface, "Fixture") {
+		t.Errorf("the type in the _test.go file is wrapped:\n%s", iface)
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/internalfoo": {"foo.go": `package internalfoo
+
+type Client struct{}
+
+func (c *Client) Get() string { return "" }
+`},
+	})
+	opts := testOptions(gopath, "example.com/internalfoo")
+	opts.StripPrefix = "internal"
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+
+	if len(files) != 2 || files[fooIface] == "" || files[fooImpl] == "" {
+		t.Errorf("got files %v, want foo and fooiface", files)
+	}
+	testContains(t, fooImpl, files[fooImpl], "package foo\n",
+		"\t\"example.com/internalfoo\"\n")
+
+	opts.StripPrefix = "internalfoo"
+	var usage usageError
+	if _, err := Generate(opts); !errors.As(err, &usage) {
+		t.Errorf("got error %v stripping the whole name, want a usageError",
+			err)
+	}
+}
+
+func TestNamedResultsMatchingParams(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type S struct{}
+
+func (s *S) Copy(n int) (n2 int) { return n }
+
+func (s *S) Flip(a, b string) (b2, a2 string) { return b, a }
+
+func (s *S) Split(path string) (dir, file string, err error) { return }
+`, nil)
+
+	testContains(t, fooIface, files[fooIface],
+		"\tCopy(n int) (n2 int)\n",
+		"\tFlip(a string, b string) (b2 string, a2 string)\n",
+		"\tSplit(path string) (dir string, file string, err error)\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"\treturn x.parent.Copy(n)\n", "\treturn x.parent.Flip(a, b)\n",
+		"\treturn x.parent.Split(path)\n")
+}
+
+func TestWrapperDoc(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+// Client talks to the API.
+//
+// The zero value is ready to use.
+type Client struct{}
+
+func (c *Client) Ping() error { return nil }
+`, nil)
+	testContains(t, fooImpl, files[fooImpl],
+		"// Client talks to the API.\n//\n// The zero value is ready to use.\ntype Client struct {")
+}
+
+func TestFuncFieldGetters(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+type S struct {
+	Validate func() error
+	Format   func(int) (string, error)
+}
+`, nil)
+	testContains(t, fooIface, files[fooIface],
+		"\tValidate() func() error\n", "\tFormat() func(int) (string, error)\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"\treturn x.parent.Validate\n", "\treturn x.parent.Format\n")
+}
+
+func TestGroups(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+type User struct{}
+func (u *User) Account() *Account { return nil }
+type Account struct{}
+func (a *Account) ID() int { return 0 }
+type Other struct{}
+func (o *Other) Run() {}
+`, func(opts *Options) {
+		opts.Groups = map[string]string{"User": "auth", "Account": "auth"}
+	})
+	authIface := outPkg + "/authiface/authiface.go"
+	authImpl := outPkg + "/auth/auth.go"
+	testContains(t, authIface, files[authIface],
+		"type Account interface {", "type User interface {", "\tAccount() Account\n")
+	testContains(t, authImpl, files[authImpl],
+		"type Account struct {", "type User struct {")
+	testContains(t, fooIface, files[fooIface], "type Other interface {")
+	if strings.Contains(files[fooIface], "User") {
+		t.Errorf("%s contains the grouped User:\n%s", fooIface, files[fooIface])
+	}
+
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": "package foo\ntype User struct{}\n"},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	opts.Groups = map[string]string{"Missing": "auth"}
+	var uerr usageError
+	if _, err := Generate(opts); !errors.As(err, &uerr) {
+		t.Errorf("Generate grouping a missing struct returned %v, want a usage error", err)
+	}
+}
+
+func TestShadowedPackageAlias(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+type S struct{}
+func (s *S) Use(foo []*S) {}
+`, nil)
+	testContains(t, fooImpl, files[fooImpl],
+		"\tsrcfoo \"example.com/foo\"\n", "\tparent *srcfoo.S\n")
+
+	files = testGenerateFoo(t, `package foo
+type S struct{}
+func (s *S) Use(ss []*S) {}
+`, nil)
+	if strings.Contains(files[fooImpl], "srcfoo") {
+		t.Errorf("%s aliases foo with nothing shadowing it:\n%s", fooImpl, files[fooImpl])
+	}
+}
+
+func TestOrder(t *testing.T) {
+	src := `package foo
+type S struct{}
+func (s *S) Zeta() {}
+func (s *S) Alpha() {}
+func (s *S) Mid() {}
+`
+	for _, tt := range []struct {
+		order string
+		want  string
+	}{
+		{"", "\tZeta()\n\tAlpha()\n\tMid()\n"},
+		{"source", "\tZeta()\n\tAlpha()\n\tMid()\n"},
+		{"name", "\tAlpha()\n\tMid()\n\tZeta()\n"},
+	} {
+		files := testGenerateFoo(t, src, func(opts *Options) { opts.Order = tt.order })
+		testContains(t, fooIface, files[fooIface], tt.want)
+	}
+}
+
+func TestExportData(t *testing.T) {
+	gopath := testGopath(t, nil)
+	opts := testOptions(gopath, "bytes")
+	opts.ExportData = true
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+	iface := outPkg + "/bytesiface/bytesiface.go"
+	impl := outPkg + "/bytes/bytes.go"
+	testContains(t, iface, files[iface],
+		"type Buffer interface {", "\tLen() int\n", "\tWriteString(s string) (n int, err error)\n")
+	testContains(t, impl, files[impl],
+		"\tparent *bytes.Buffer\n", "\treturn x.parent.Len()\n")
+}
+
+func TestExportDataGenericTypes(t *testing.T) {
+	gopath := testGopath(t, nil)
+	opts := testOptions(gopath, "sync/atomic")
+	opts.ExportData = true
+	// The Swap methods warn that they aren't sort.Interface's.
+	opts.Warn = func(error) {}
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+	iface := outPkg + "/atomiciface/atomiciface.go"
+	impl := outPkg + "/atomic/atomic.go"
+	testContains(t, iface, files[iface],
+		"type Pointer[T any] interface {", "\tLoad() *T\n",
+		"\tStore(val *T)\n")
+	testContains(t, impl, files[impl],
+		"\tparent *atomic.Pointer[T]\n", "\treturn x.parent.Load()\n")
+}
+
+func TestTypedErrors(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/empty": {"README": "Nothing to wrap.\n"},
+	})
+	if _, err := Generate(testOptions(gopath, "example.com/empty")); !errors.Is(err, ErrNoPackages) {
+		t.Errorf("Generate of a package with no Go files returned %v, want ErrNoPackages", err)
+	}
+
+	var warnings []error
+	testGenerateFoo(t, `package foo
+func Map[T any](ts []T) []T { return ts }
+type S struct{}
+func (s *S) Do(o opts) {}
+type opts struct{}
+`, func(opts *Options) {
+		opts.Warn = func(err error) { warnings = append(warnings, err) }
+	})
+	var unsupported *UnsupportedTypeError
+	var unexported *UnexportedDependencyError
+	for _, err := range warnings {
+		switch {
+		case errors.As(err, &unsupported):
+			if unsupported.Member != "foo.Map" {
+				t.Errorf("UnsupportedTypeError.Member = %q, want foo.Map", unsupported.Member)
+			}
+		case errors.As(err, &unexported):
+			if unexported.Member != "foo.S.Do" || unexported.Type != "opts" {
+				t.Errorf("UnexportedDependencyError = %+v, want foo.S.Do using opts", unexported)
+			}
+		}
+	}
+	if unsupported == nil {
+		t.Errorf("no UnsupportedTypeError in %v", warnings)
+	}
+	if unexported == nil {
+		t.Errorf("no UnexportedDependencyError in %v", warnings)
+	}
+}
+
+func TestGroupedResults(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+type S struct{}
+func (s *S) Pair() (a, b int) { return 1, 2 }
+func Bounds(lo, hi int) (min, max int) { return lo, hi }
+`, func(opts *Options) { opts.GenFakes = true })
+	testContains(t, fooIface, files[fooIface], "\tPair() (a int, b int)\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *S) Pair() (a int, b int) {\n\treturn x.parent.Pair()\n",
+		"func Bounds(lo int, hi int) (min int, max int) {\n\treturn foo.Bounds(lo, hi)\n")
+	testContains(t, fooFakes, files[fooFakes],
+		"\tPairFunc  func() (a int, b int)\n", "func (f *S) Pair() (a int, b int) {\n")
+}
+
+func TestStdlibNamedPackage(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/time": {"time.go": `package time
+
+import "time"
+
+type Clock struct{}
+
+func (c *Clock) Now() time.Time { return time.Now() }
+func (c *Clock) Self() *Clock   { return c }
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/time"))
+	testVet(t, gopath, files)
+	impl := outPkg + "/time/time.go"
+	testContains(t, impl, files[impl],
+		"\tsrctime \"example.com/time\"\n", "\t\"time\"\n",
+		"\tparent *srctime.Clock\n", "func (x *Clock) Now() time.Time {\n")
+}
+
+func TestPointerToForeignInterface(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+import "io"
+type S struct {
+	Out *io.Writer
+}
+func (s *S) Set(w *io.Writer, rest ...*io.Writer) *io.Writer { return w }
+`, func(opts *Options) { opts.GenFakes = true })
+	for _, name := range []string{fooIface, fooImpl, fooFakes} {
+		testContains(t, name, files[name], "\t\"io\"\n",
+			"Set(w *io.Writer, rest ...*io.Writer) ")
+	}
+	testContains(t, fooIface, files[fooIface],
+		"\tSet(w *io.Writer, rest ...*io.Writer) *io.Writer\n", "\tOut() *io.Writer\n")
+}
+
+func TestConstraintTypeSets(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+type Number interface{ ~int | ~float64 }
+type Acc[T Number] struct{ total T }
+func (a *Acc[T]) Add(v T) T { a.total += v; return a.total }
+type Vec[T interface{ ~int8 | ~uint8 }] struct{}
+func (v *Vec[T]) At(i int) (t T) { return }
+`, nil)
+	testContains(t, fooIface, files[fooIface],
+		"type Acc[T foo.Number] interface {",
+		"type Vec[T interface{ ~int8 | ~uint8 }] interface {")
+	testContains(t, fooImpl, files[fooImpl],
+		"type Acc[T foo.Number] struct {",
+		"type Vec[T interface{ ~int8 | ~uint8 }] struct {")
+}
+
+func TestNestedCompositeFields(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+type Cell struct{}
+func (c *Cell) V() int { return 0 }
+type Board struct {
+	Grid *[8][8]Cell
+	Rows *[]map[string]*Cell
+	Ring [8]*Cell
+}
+func (b *Board) Nest(m map[string][]*[3]Cell) {}
+`, nil)
+	testContains(t, fooIface, files[fooIface],
+		"\tGrid() *[8][8]Cell\n", "\tRows() *[]map[string]Cell\n",
+		"\tRing() [8]Cell\n", "\tNest(m map[string][]*[3]Cell)\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *Board) Grid() *[8][8]fooiface.Cell {",
+		"func (x *Board) Rows() *[]map[string]fooiface.Cell {",
+		"func (x *Board) Ring() [8]fooiface.Cell {",
+		"map[string][]*[3]fooiface.Cell) map[string][]*[3]foo.Cell {")
+}
+
+func TestNoFieldAccessors(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+type S struct {
+	Name string
+}
+func (s *S) Run() error { return nil }
+`, func(opts *Options) { opts.NoFieldAccessors = true })
+	testContains(t, fooIface, files[fooIface], "\tRun() error\n")
+	testContains(t, fooImpl, files[fooImpl], "\tparent *foo.S\n")
+	for _, name := range []string{fooIface, fooImpl} {
+		if strings.Contains(files[name], "Name()") {
+			t.Errorf("%s has an accessor for Name:\n%s", name, files[name])
+		}
+	}
+}
+
+func TestGenericStack(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Stack[T any] struct{ items []T }
+
+func (s *Stack[T]) Push(v T) { s.items = append(s.items, v) }
+
+func (s *Stack[T]) Pop() (T, bool) {
+	var zero T
+	if len(s.items) == 0 {
+		return zero, false
+	}
+	v := s.items[len(s.items)-1]
+	s.items = s.items[:len(s.items)-1]
+	return v, true
+}
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	testContains(t, fooIface, files[fooIface],
+		"type Stack[T any] interface {\n\tPush(v T)\n\tPop() (T, bool)\n}")
+	testContains(t, fooImpl, files[fooImpl],
+		"type Stack[T any] struct {\n\tparent *foo.Stack[T]\n}",
+		"func (x *Stack[T]) Push(v T) {\n\tx.parent.Push(v)\n}")
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	srcfoo "example.com/foo"
+	"example.com/out/foo"
+	"example.com/out/fooiface"
+)
+
+func main() {
+	var s fooiface.Stack[string] = foo.NewStack(&srcfoo.Stack[string]{})
+	s.Push("a")
+	s.Push("b")
+	fmt.Println(s.Pop())
+	fmt.Println(s.Pop())
+	fmt.Println(s.Pop())
+}
+`)
+	if want := "b true\na true\n false\n"; out != want {
+		t.Errorf("popping the stack printed %q, want %q", out, want)
+	}
+}
+
+func TestReport(t *testing.T) {
+	var reports []PackageReport
+	testGenerateFoo(t, `package foo
+type S struct{}
+func (s *S) Do(o opts) {}
+func (s *S) Run() {}
+type opts struct{}
+func Map[T any](ts []T) []T { return ts }
+func New() *S { return nil }
+`, func(opts *Options) {
+		opts.Report = func(r PackageReport) { reports = append(reports, r) }
+	})
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1: %+v", len(reports), reports)
+	}
+	r := reports[0]
+	if r.Package != "foo" || fmt.Sprint(r.Structs) != "[S]" || fmt.Sprint(r.Functions) != "[New]" {
+		t.Errorf("report wraps %s %v %v, want foo [S] [New]", r.Package, r.Structs, r.Functions)
+	}
+	want := map[SkippedMember]bool{
+		{Member: "foo.Map", Reason: "generic functions are not supported"}: true,
+		{Member: "foo.S.Do", Reason: "it uses the unexported type opts"}:   true,
+	}
+	for _, skipped := range r.Skipped {
+		if !want[skipped] {
+			t.Errorf("report skips %+v", skipped)
+		}
+		delete(want, skipped)
+	}
+	for skipped := range want {
+		t.Errorf("report doesn't skip %+v", skipped)
+	}
+}
+
+func TestReportAccessorCollisions(t *testing.T) {
+	// As in TestFieldAccessorCollidesWithMethod, the source doesn't
+	// compile, so only the report is checked.
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type User struct {
+	Name string
+	ID   int
+}
+
+func (u *User) Name() string    { return "" }
+func (u *User) GetName() string { return "" }
+func (u *User) ID() int         { return 0 }
+`},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	var reports []PackageReport
+	opts.Report = func(r PackageReport) { reports = append(reports, r) }
+	opts.Warn = func(error) {}
+	testGenerate(t, opts)
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1: %+v", len(reports), reports)
+	}
+	r := reports[0]
+	want := SkippedMember{
+		Member: "foo.User.Name",
+		Reason: "its accessors Name and GetName are already taken",
+	}
+	if len(r.Skipped) != 1 || r.Skipped[0] != want {
+		t.Errorf("report skips %+v, want %+v", r.Skipped, want)
+	}
+	if len(r.Warnings) != 1 || r.Warnings[0] != "foo.User.ID: accessor "+
+		"collides with method ID, using GetID" {
+		t.Errorf("report warns %q, want the ID accessor renamed", r.Warnings)
+	}
+}
+
+func TestForeignGenericInstantiation(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/lru": {"lru.go": `package lru
+
+type Cache[K comparable, V any] struct{}
+
+type List[T any] struct{}
+`},
+		"example.com/foo": {"foo.go": `package foo
+
+import "example.com/lru"
+
+type Item struct{}
+
+type S struct {
+	Cache *lru.Cache[string, int]
+}
+
+func (s *S) Items() []*lru.List[Item] { return nil }
+`},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	opts.GenFakes = true
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+	testContains(t, fooIface, files[fooIface], "\t\"example.com/lru\"\n",
+		"\tCache() *lru.Cache[string, int]\n", "\tItems() []*lru.List[foo.Item]\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *S) Cache() *lru.Cache[string, int] {",
+		"func (x *S) Items() []*lru.List[foo.Item] {")
+	testContains(t, fooFakes, files[fooFakes], "\t\"example.com/lru\"\n")
+}
+
+func TestUnformattedOutput(t *testing.T) {
+	defer func(f func([]byte) ([]byte, error)) { formatSource = f }(formatSource)
+	formatSource = func(src []byte) ([]byte, error) { return src, nil }
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+type S struct {
+	Name string
+}
+func (s *S) Run() error { return nil }
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	for name, want := range map[string]string{
+		fooIface: `// Auto generated code DO NOT EDIT
+
+// Package fooiface contains the generated interfaces of foo.
+package fooiface
+
+type S interface {
+    Name() string
+    Run() error
+}
+`,
+		fooImpl: `// Auto generated code DO NOT EDIT
+
+// Package foo contains the generated wrappers implementing the interfaces in fooiface.
+package foo
+
+import (
+    "example.com/foo"
+    "example.com/out/fooiface"
+)
+
+type S struct {
+    parent *foo.S
+}
+
+var _ fooiface.S = (*S)(nil)
+
+func NewS(parent *foo.S) *S {
+    return &S{parent: parent}
+}
+
+// wrapS wraps p, keeping nil pointers nil.
+func wrapS(p *foo.S) fooiface.S {
+    if p == nil {
+        return nil
+    }
+    return NewS(p)
+}
+
+// unwrapS returns the struct wrapped by w, which must
+// have been created by NewS.
+func unwrapS(w fooiface.S) *foo.S {
+    if w == nil {
+        return nil
+    }
+    return w.(*S).parent
+}
+
+func (x *S) Name() string {
+    return x.parent.Name
+}
+
+func (x *S) Run() error {
+    return x.parent.Run()
+}
+`,
+	} {
+		if got := files[name]; got != want {
+			t.Errorf("%s before formatting is\n%s\nwant\n%s", name, got, want)
+		}
+		// gofmt only has the indentation left to fix.
+		formatted, err := format.Source([]byte(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.ReplaceAll(want, "    ", "\t"); string(formatted) != got {
+			t.Errorf("formatting %s changes more than its indentation:\n%s", name, formatted)
+		}
+	}
+}
+
+func TestDeepEmbedding(t *testing.T) {
+	src := `package foo
+type A struct{}
+func (a *A) DoA() {}
+func (a A) ValA() int { return 0 }
+type B struct{ *A }
+func (b B) DoB() {}
+type C struct{ B }
+func (c *C) DoC() {}
+`
+	for _, mirror := range []bool{false, true} {
+		files := testGenerateFoo(t, src, func(opts *Options) {
+			opts.MirrorReceivers = mirror
+		})
+		testContains(t, fooIface, files[fooIface],
+			"type C interface {\n\tDoC()\n\tDoB()\n\tDoA()\n\tValA() int\n}")
+	}
+}
+
+func TestIfaceNameAffixes(t *testing.T) {
+	src := `package foo
+type S struct{}
+func (s *S) Self() *S { return s }
+`
+	files := testGenerateFoo(t, src, func(opts *Options) {
+		opts.IfaceNameSuffix = "Interface"
+		opts.GenFakes = true
+	})
+	testContains(t, fooIface, files[fooIface],
+		"type SInterface interface {\n\tSelf() SInterface\n}")
+	testContains(t, fooImpl, files[fooImpl],
+		"var _ fooiface.SInterface = (*S)(nil)\n",
+		"func (x *S) Self() fooiface.SInterface {")
+	testContains(t, fooFakes, files[fooFakes],
+		"var _ fooiface.SInterface = (*S)(nil)\n")
+
+	files = testGenerateFoo(t, src, func(opts *Options) { opts.IfaceNamePrefix = "I" })
+	testContains(t, fooIface, files[fooIface], "type IS interface {\n\tSelf() IS\n}")
+	testContains(t, fooImpl, files[fooImpl], "var _ fooiface.IS = (*S)(nil)\n")
+}
+
+func TestBrokenPackageAmongGood(t *testing.T) {
+	pkgs := map[string]map[string]string{
+		"example.com/multi": {
+			"a.go":      "package a\n\ntype A struct{}\n\nfunc (a *A) Get() {}\n",
+			"b.go":      "package b\n\ntype B struct{}\n\nfunc (b *B) Get() {}\n",
+			"broken.go": "package broken\n\ntype C struct{\n",
+			"c.go":      "package c\n\ntype C struct{}\n\nfunc (c *C) Get() {}\n",
+		},
+	}
+	gopath := testGopath(t, pkgs)
+	opts := testOptions(gopath, "example.com/multi")
+	if files, err := Generate(opts); len(files) != 0 || err == nil {
+		t.Errorf("without ContinueOnError got %d files and error %v, "+
+			"want no files and an error", len(files), err)
+	}
+
+	opts.ContinueOnError = true
+	files, err := Generate(opts)
+	var parse parseError
+	if !errors.As(err, &parse) || !strings.HasPrefix(err.Error(), "package broken:") {
+		t.Errorf("got error %v, want a parseError for package broken", err)
+	}
+	srcs := testFiles(t, files)
+	for _, name := range []string{"a", "b", "c"} {
+		for _, file := range []string{name + "iface/" + name + "iface.go", name + "/" + name + ".go"} {
+			if _, ok := srcs[outPkg+"/"+file]; !ok {
+				t.Errorf("%s wasn't generated: %v", file, srcs)
+			}
+		}
+	}
+	if len(srcs) != 6 {
+		t.Errorf("got %d files, want the 6 of a, b and c", len(srcs))
+	}
+
+	// Without a package clause the file's package is unknown, so
+	// nothing can be generated.
+	pkgs["example.com/multi"]["broken.go"] = "type C struct{}\n"
+	gopath = testGopath(t, pkgs)
+	opts = testOptions(gopath, "example.com/multi")
+	opts.ContinueOnError = true
+	if files, err := Generate(opts); len(files) != 0 || !errors.As(err, &parse) {
+		t.Errorf("with no package clause got %d files and error %v, "+
+			"want no files and a parseError", len(files), err)
+	}
+}
+
+func TestSiblingPackageTypes(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/bar": {"bar.go": `package bar
+
+type Thing struct{}
+
+func (t *Thing) Name() string { return "" }
+`},
+		"example.com/foo": {"foo.go": `package foo
+
+import "example.com/bar"
+
+type S struct{}
+
+func (s *S) Thing() *bar.Thing { return nil }
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+	testVet(t, gopath, files)
+	// bar isn't generated in the same run, so its structs are used as
+	// they are.
+	testContains(t, fooIface, files[fooIface],
+		"\t\"example.com/bar\"\n", "\tThing() *bar.Thing\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *S) Thing() *bar.Thing {\n\treturn x.parent.Thing()\n}")
+}
+
+func TestExtraMethods(t *testing.T) {
+	src := `package foo
+type Client struct{}
+func (c *Client) Get() string { return "" }
+func (c *Client) Reset() {}
+type Server struct{}
+func (s *Server) Serve() {}
+`
+	files := testGenerateFoo(t, src, func(opts *Options) {
+		opts.ExcludeMethods = []string{"Reset"}
+		opts.ExtraMethods = map[string][]string{
+			"Client": {"Close() error", "Peer() *Client", "Reset()"},
+		}
+		opts.GenFakes = true
+	})
+	testContains(t, fooIface, files[fooIface],
+		"type Client interface {\n\tGet() string\n\tClose() error\n\tPeer() Client\n\tReset()\n}",
+		"type Server interface {\n\tServe()\n}")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *Client) Close() error {",
+		`panic("foo.Client has no Close method to forward to")`,
+		"func (x *Client) Reset() {\n\tx.parent.Reset()\n}")
+	testContains(t, fooFakes, files[fooFakes], "\tCloseFunc  func() error\n")
+
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": src},
+	})
+	for _, extra := range []map[string][]string{
+		{"Missing": {"Close() error"}},
+		{"Client": {"Close( error"}},
+		{"Client": {"close() error"}},
+	} {
+		opts := testOptions(gopath, "example.com/foo")
+		opts.ExtraMethods = extra
+		var uerr usageError
+		if _, err := Generate(opts); !errors.As(err, &uerr) {
+			t.Errorf("Generate with the extra methods %v returned %v, want a usage error", extra, err)
+		}
+	}
+}
+
+func TestLineDirectives(t *testing.T) {
+	files := testGenerateFoo(t, `//line gen.y:1
+package foo
+
+import "io"
+
+//line gen.y:100
+type S struct {
+	Out /*line gen.y:7:3*/ map[string]io.Writer
+}
+
+//line other.y:1:1
+func (s *S) Copy(dst io.Writer, src []*S) (int64, error) { return 0, nil }
+`, nil)
+	testContains(t, fooIface, files[fooIface],
+		"\tOut() map[string]io.Writer\n",
+		"\tCopy(dst io.Writer, src []S) (int64, error)\n")
+}
+
+func TestFuncsInterface(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+import "strings"
+
+func Upper(s string) string { return strings.ToUpper(s) }
+`},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	opts.GenFakes = true
+	files := testGenerate(t, opts)
+
+	testContains(t, fooIface, files[fooIface],
+		"type FooFuncs interface {\n\tUpper(s string) string\n}")
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+	"strings"
+
+	"example.com/out/foo"
+	"example.com/out/foofakes"
+	"example.com/out/fooiface"
+)
+
+func shout(funcs fooiface.FooFuncs) string { return funcs.Upper("hi") }
+
+func main() {
+	fmt.Println(shout(foo.DefaultFooFuncs), shout(foo.NewFooFuncs()))
+	fake := &foofakes.FooFuncs{UpperFunc: strings.ToLower}
+	fmt.Println(shout(fake), fake.UpperCalls)
+}
+`)
+	if want := "HI HI\nhi 1\n"; out != want {
+		t.Errorf("calling Upper printed %q, want %q", out, want)
+	}
+}
+
+func TestSkipDeprecated(t *testing.T) {
+	src := `package foo
+
+// Deprecated: use S.
+type Old struct{}
+
+func (o *Old) Run() {}
+
+type S struct {
+	// Deprecated: use N.
+	Legacy int
+	N      int
+}
+
+// Deprecated: use Get.
+func (s *S) Fetch() {}
+
+func (s *S) Get() {}
+
+// Deprecated: use New.
+func Make() *S { return nil }
+
+func New() *S { return nil }
+`
+	files := testGenerateFoo(t, src, func(opts *Options) { opts.SkipDeprecated = true })
+	testContains(t, fooIface, files[fooIface],
+		"type S interface {\n\tN() int\n\tGet()\n}",
+		"type FooFuncs interface {\n\tNew() S\n}")
+	for _, name := range []string{"Old", "Legacy", "Fetch", "Make"} {
+		if strings.Contains(files[fooIface], name) {
+			t.Errorf("%s has the deprecated %s:\n%s", fooIface, name, files[fooIface])
+		}
+	}
+
+	files = testGenerateFoo(t, src, nil)
+	testContains(t, fooIface, files[fooIface],
+		"type Old interface {", "\tLegacy() int\n", "\tFetch()\n", "\tMake() S\n")
+}
+
+func TestFunctionsWrapLocalStructs(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+type S struct{}
+func (s *S) Peer() *S { return s }
+func New(name string) *S { return nil }
+func Use(s *S) {}
+`, nil)
+	testContains(t, fooIface, files[fooIface],
+		"type S interface {\n\tPeer() S\n}",
+		"type FooFuncs interface {\n\tNew(name string) S\n\tUse(s S)\n}")
+	// The function's result is wrapped just as the method's is.
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *S) Peer() fooiface.S {\n\tr0 := x.parent.Peer()\n\treturn wrapS(r0)\n}",
+		"func New(name string) fooiface.S {\n\tr0 := foo.New(name)\n\treturn wrapS(r0)\n}",
+		"func Use(s fooiface.S) {\n\tfoo.Use(unwrapS(s))\n}")
+}
+
+func TestNoHeaderNoPackage(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": "package foo\n\ntype S struct{}\n\nfunc (s *S) Run() {}\n"},
+	})
+	opts := testOptions(gopath, "example.com/foo")
+	opts.NoHeader = true
+	files := testGenerate(t, opts)
+	testVet(t, gopath, files)
+	if src := files[fooIface]; !strings.HasPrefix(src, "// Package fooiface ") {
+		t.Errorf("with NoHeader %s doesn't start with its package doc:\n%s", fooIface, src)
+	}
+
+	opts.NoPackage = true
+	files = testGenerate(t, opts)
+	for name, want := range map[string]string{
+		fooIface: "type S interface {\n\tRun()\n}\n",
+		fooImpl:  "import (\n\t\"example.com/foo\"\n\t\"example.com/out/fooiface\"\n)\n\ntype S struct {\n",
+	} {
+		if !strings.HasPrefix(files[name], want) {
+			t.Errorf("%s doesn't start with %q:\n%s", name, want, files[name])
+		}
+		if strings.Contains(files[name], "DO NOT EDIT") || strings.Contains(files[name], "package ") {
+			t.Errorf("%s has a header or package clause:\n%s", name, files[name])
+		}
+	}
+	testContains(t, fooImpl, files[fooImpl], "func (x *S) Run() {\n\tx.parent.Run()\n}")
+}
+
+func TestRecoveredPackageName(t *testing.T) {
+	// The directory isn't named after the package, and the parser
+	// recovers from the error after the package clause.
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/v2": {
+			"a.go": "package foo\n\ntype A struct{}\n\nfunc (a *A) Get( {}\n",
+			"b.go": "package foo\n\ntype B struct{}\n\nfunc (b *B) Get() {}\n",
+		},
+	})
+	opts := testOptions(gopath, "example.com/v2")
+	var parse parseError
+	if _, err := Generate(opts); !errors.As(err, &parse) ||
+		!strings.HasPrefix(err.Error(), "package foo:") {
+		t.Errorf("got error %v, want a parseError for package foo", err)
+	}
+
+	dir := filepath.Join(gopath, "src", "example.com", "v2")
+	opts.Overlay = map[string][]byte{
+		filepath.Join(dir, "a.go"): []byte("package foo\n\ntype A struct{}\n\nfunc (a *A) Get() {}\n"),
+	}
+	files := testGenerate(t, opts)
+	testContains(t, fooIface, files[fooIface],
+		"type A interface {\n\tGet()\n}", "type B interface {\n\tGet()\n}")
+}
+
+func TestSelfQualifiedResults(t *testing.T) {
+	// foo can't import itself, so foo.Bar is the Bar of another
+	// package named foo.
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/old/foo": {"foo.go": "package foo\n\ntype Bar struct{}\n\nfunc (b *Bar) X() {}\n"},
+		"example.com/foo": {"foo.go": `package foo
+
+import foo "example.com/old/foo"
+
+type Bar struct{}
+
+func (b *Bar) Old() *foo.Bar { return nil }
+func (b *Bar) Self() *Bar    { return b }
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+	testVet(t, gopath, files)
+	testContains(t, fooIface, files[fooIface], "\t\"example.com/old/foo\"\n",
+		"type Bar interface {\n\tOld() *foo.Bar\n\tSelf() Bar\n}")
+	testContains(t, fooImpl, files[fooImpl],
+		"\tsrcfoo \"example.com/foo\"\n", "\t\"example.com/old/foo\"\n",
+		"func (x *Bar) Old() *foo.Bar {\n\treturn x.parent.Old()\n}",
+		"func (x *Bar) Self() fooiface.Bar {\n\tr0 := x.parent.Self()\n\treturn wrapBar(r0)\n}")
+}
+
+func TestParamsShadowingImports(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+import "time"
+type Item struct{}
+func (i *Item) ID() int { return 0 }
+type S struct{}
+func (s *S) Serve(items map[time.Time]*Item, time time.Duration) (time_ *Item) { return nil }
+func Serve(items map[time.Time]*Item, time time.Duration) {}
+`, nil)
+	// The interfaces keep the names, only the wrappers' bodies refer
+	// to time.
+	testContains(t, fooIface, files[fooIface],
+		"\tServe(items map[time.Time]Item, time time.Duration) (time_ Item)\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *S) Serve(items map[time.Time]fooiface.Item, time__ time.Duration) (time_ fooiface.Item) {",
+		"}(items), time__)\n",
+		"func Serve(items map[time.Time]fooiface.Item, time_ time.Duration) {")
+}
+
+func TestUnexportedEmbeds(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+type base struct{ *inner }
+func (b *base) Ping() error { return nil }
+func (b base) Name() string { return "" }
+type inner struct{}
+func (i *inner) Deep() {}
+func (i *inner) hidden() {}
+type Server struct{ *base }
+func (s *Server) Serve() {}
+`, nil)
+	testContains(t, fooIface, files[fooIface],
+		"type Server interface {\n\tServe()\n\tPing() error\n\tName() string\n\tDeep()\n}")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *Server) Ping() error {\n\treturn x.parent.Ping()\n}")
+	for _, name := range []string{"base", "inner", "hidden"} {
+		if strings.Contains(files[fooIface], name) {
+			t.Errorf("%s has %s:\n%s", fooIface, name, files[fooIface])
+		}
+	}
+}
+
+func BenchmarkParsesPerFile(b *testing.B) {
+	const files = 20
+	gopath := b.TempDir()
+	dir := filepath.Join(gopath, "src", "example.com", "large")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < files; i++ {
+		src := fmt.Sprintf(`package large
+
+type S%[1]d struct{ Name string }
+
+func (s *S%[1]d) Get(key string) (*S%[1]d, error) { return s, nil }
+`, i)
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d.go", i)),
+			[]byte(src), 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Setenv("GOPATH", gopath)
+	b.Setenv("GO111MODULE", "off")
+	defer func(gopath string) { build.Default.GOPATH = gopath }(build.Default.GOPATH)
+	build.Default.GOPATH = gopath
+	opts := Options{
+		Input:   "example.com/large",
+		Output:  filepath.Join(gopath, "src", "example.com", "out"),
+		BasePkg: "example.com/out",
+	}
+
+	// countParses reports how many times each of the package's files
+	// is parsed by read.
+	countParses := func(b *testing.B, read func()) {
+		defer func(f func(*token.FileSet, string, interface{}, parser.Mode) (*ast.File, error)) {
+			parseFile = f
+		}(parseFile)
+		parses := 0
+		parseFile = func(fset *token.FileSet, name string, src interface{}, mode parser.Mode) (*ast.File, error) {
+			parses++
+			return parser.ParseFile(fset, name, src, mode)
+		}
+		for i := 0; i < b.N; i++ {
+			read()
+		}
+		b.ReportMetric(float64(parses)/float64(b.N*files), "parses/file")
+	}
+
+	// getFields used to parse each file again after the package was
+	// parsed.
+	b.Run("ParseTwice", func(b *testing.B) {
+		countParses(b, func() {
+			if _, err := getSubpackages(context.Background(),
+				"example.com/large", nil); err != nil {
+				b.Fatal(err)
+			}
+			fileNames, err := pkgFiles("example.com/large", nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, fileName := range fileNames {
+				if _, err := parseFile(token.NewFileSet(), fileName, nil,
+					parser.ParseComments); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+	b.Run("Generate", func(b *testing.B) {
+		countParses(b, func() {
+			if _, err := Generate(opts); err != nil {
+				b.Fatal(err)
+			}
+		})
+	})
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// typeMapper maps the types used by a wrapped package to the types
+// used for them by the generated packages, and generates the code
+// converting between the two.
+//
+// Wherever values can be converted, the package's structs and pointers
+// to them are replaced by their interfaces. Every other type declared
+// by the package is qualified with the package's name.
+type typeMapper struct {
+	pkg *Package
+	// pkgName is the name the wrapped package is referred to by,
+	// which is its own name unless it has to be imported under an
+	// alias, src<name>.
+	pkgName string
+	// ifaceName is the name the interface package is referred to by.
+	// It is "" when mapping types for the interface package itself.
+	ifaceName string
+	ifacePath string
+	// imports maps the import paths of the packages referred to by
+	// the mapped types to the names they are imported as, "" if they
+	// are imported under their own name.
+	imports map[string]string
+	// typeParams are the names of the type parameters in scope, which
+	// are left as they are.
+	typeParams map[string]bool
+	// ifacePrefix and ifaceSuffix are added to a struct's name to
+	// name its interface.
+	ifacePrefix string
+	ifaceSuffix string
+}
+
+func newTypeMapper(pkg *Package, ifaceName, ifacePath string) *typeMapper {
+	m := &typeMapper{
+		pkg:       pkg,
+		pkgName:   pkg.Name,
+		ifaceName: ifaceName,
+		ifacePath: ifacePath,
+		imports:   make(map[string]string),
+	}
+	// A package's own name isn't in scope in its files, so it can
+	// import another package of the same name, such as a package time
+	// importing "time". The generated code has to tell them apart.
+	if _, ok := pkg.Imports[pkg.Name]; ok {
+		m.aliasPkg()
+	}
+	return m
+}
+
+// ifaceTypeName returns the name of the interface generated for the
+// struct, or the functions interface, name.
+func (m *typeMapper) ifaceTypeName(name string) string {
+	return m.ifacePrefix + name + m.ifaceSuffix
+}
+
+// aliasPkg refers to the wrapped package as src<name> rather than by
+// its name.
+func (m *typeMapper) aliasPkg() {
+	m.pkgName = "src" + m.pkg.Name
+}
+
+// unshadow returns params and results with every name that would shadow
+// a package the generated code can refer to, in the body of a function
+// they're the params and results of, renamed by appending underscores.
+// The body could otherwise fail to name a type of that package, e.g.
+// time.Time when a param is called time.
+func (m *typeMapper) unshadow(params, results []*Field) ([]*Field, []*Field) {
+	pkgs := map[string]bool{m.pkgName: true, m.ifaceName: true}
+	for name := range m.pkg.Imports {
+		pkgs[name] = true
+	}
+	used := make(map[string]bool)
+	for _, fields := range [][]*Field{params, results} {
+		for _, field := range fields {
+			used[field.Name] = true
+		}
+	}
+
+	rename := func(fields []*Field) []*Field {
+		// fields is only copied once a name has to change.
+		renamed, copied := fields, false
+		for i, field := range fields {
+			if field.Name == "" || !pkgs[field.Name] {
+				continue
+			}
+			if !copied {
+				renamed, copied = append([]*Field(nil), fields...), true
+			}
+			f := *field
+			for pkgs[f.Name] || used[f.Name] {
+				f.Name += "_"
+			}
+			used[f.Name] = true
+			renamed[i] = &f
+		}
+		return renamed
+	}
+	return rename(params), rename(results)
+}
+
+// unshadowMethods returns methods with their params and results renamed
+// as unshadow does.
+func (m *typeMapper) unshadowMethods(methods []*Method) []*Method {
+	var renamed []*Method
+	for _, method := range methods {
+		r := *method
+		r.Params, r.Results = m.unshadow(method.Params, method.Results)
+		renamed = append(renamed, &r)
+	}
+	return renamed
+}
+
+// setTypeParams sets the type parameters in scope for the types mapped
+// next to params, those of a generic struct.
+func (m *typeMapper) setTypeParams(params []*Field) {
+	m.typeParams = typeParamNames(params)
+}
+
+// typeParamList renders params as a type parameter list, e.g.
+// [K comparable, V any], with their constraints mapped. It's "" if
+// there are no params.
+func (m *typeMapper) typeParamList(params []*Field) string {
+	if len(params) == 0 {
+		return ""
+	}
+	var list []string
+	for _, param := range params {
+		constraint := param.Type
+		if expr, err := parseType(constraint); err == nil {
+			constraint = m.typeString(expr, false)
+		}
+		list = append(list, param.Name+" "+constraint)
+	}
+	return "[" + strings.Join(list, ", ") + "]"
+}
+
+// typeArgList renders the names of the type parameters params as the
+// type arguments instantiating a generic type with them, e.g. [K, V].
+// It's "" if there are no params.
+func typeArgList(params []*Field) string {
+	if len(params) == 0 {
+		return ""
+	}
+	var names []string
+	for _, param := range params {
+		names = append(names, param.Name)
+	}
+	return "[" + strings.Join(names, ", ") + "]"
+}
+
+// addImport records that the package with the given import path is
+// referred to as name. If name is what the package would be called
+// anyway, it's imported without one.
+func (m *typeMapper) addImport(importPath, name string) {
+	if name == path.Base(importPath) {
+		name = ""
+	}
+	m.imports[importPath] = name
+}
+
+// Imports returns the import specs, sorted by import path, of the
+// packages referred to by the types mapped so far.
+func (m *typeMapper) Imports() []string {
+	var paths []string
+	for importPath := range m.imports {
+		paths = append(paths, importPath)
+	}
+	sort.Strings(paths)
+
+	var imports []string
+	for _, importPath := range paths {
+		spec := strconv.Quote(importPath)
+		if name := m.imports[importPath]; name != "" {
+			spec = name + " " + spec
+		}
+		imports = append(imports, spec)
+	}
+	return imports
+}
+
+// ifaceType returns the type the generated code uses for typ.
+func (m *typeMapper) ifaceType(typ string) string {
+	expr, err := parseType(typ)
+	if err != nil {
+		return typ
+	}
+	return types.ExprString(m.mapExpr(expr, true))
+}
+
+// fieldList renders fields as a parameter or result list using the
+// types the generated code uses for them.
+func (m *typeMapper) fieldList(fields []*Field) string {
+	var list string
+	prefix := ""
+	for _, field := range fields {
+		list += prefix
+		if field.Name != "" {
+			list += field.Name + " "
+		}
+		list += m.ifaceType(field.Type)
+		prefix = ", "
+	}
+	return list
+}
+
+// resultList renders results as a function's result list: nothing when
+// there are no results, the bare type for a single unnamed result and
+// a parenthesised list otherwise.
+func (m *typeMapper) resultList(results []*Field) string {
+	switch {
+	case len(results) == 0:
+		return ""
+	case len(results) == 1 && results[0].Name == "":
+		return m.ifaceType(results[0].Type)
+	}
+	return "(" + m.fieldList(results) + ")"
+}
+
+// forward returns the body of a function forwarding to call, a function
+// or method with the given params and results. The arguments and
+// results are converted to and from the types the generated code uses.
+func (m *typeMapper) forward(call string, params, results []*Field) string {
+	var args []string
+	for _, param := range params {
+		expr, err := parseType(param.Type)
+		if err != nil {
+			args = append(args, param.Name)
+			continue
+		}
+		args = append(args, m.convertArg(expr, param.Name, false))
+	}
+
+	var resultTypes []ast.Expr
+	for _, result := range results {
+		expr, err := parseType(result.Type)
+		if err != nil {
+			// Not being able to parse the type means it can't be
+			// converted either.
+			expr = ast.NewIdent(result.Type)
+		}
+		resultTypes = append(resultTypes, expr)
+	}
+
+	// The results are held in variables named after a prefix that no
+	// param or named result shadows.
+	used := make(map[string]bool)
+	for _, fields := range [][]*Field{params, results} {
+		for _, field := range fields {
+			used[field.Name] = true
+		}
+	}
+	shadowed := func(prefix string) bool {
+		for i := range results {
+			if used[fmt.Sprintf("%s%d", prefix, i)] {
+				return true
+			}
+		}
+		return false
+	}
+	prefix := "r"
+	for shadowed(prefix) {
+		prefix += "r"
+	}
+
+	call += "(" + strings.Join(args, ", ") + ")"
+	return m.returnStmt(call, resultTypes, prefix, true)
+}
+
+// forwardField returns the body of a function returning the field
+// expression expr of type typ, converted to the type the generated code
+// uses for it.
+func (m *typeMapper) forwardField(expr, typ string) string {
+	parsed, err := parseType(typ)
+	if err != nil || !m.converts(parsed) {
+		return "return " + expr
+	}
+	// The field is copied so that wrapping a value can't alias the
+	// field itself.
+	return "v := " + expr + "\nreturn " + m.convert(parsed, "v", true)
+}
+
+// converts reports whether values of typ have to be converted to be
+// used as the type the generated code uses for it.
+func (m *typeMapper) converts(typ ast.Expr) bool {
+	return types.ExprString(m.mapExpr(typ, true)) !=
+		types.ExprString(m.mapExpr(typ, false))
+}
+
+// returnStmt returns the statements returning the results of call,
+// which have the types results. The results are wrapped if wrap is set
+// and unwrapped otherwise. Results that have to be converted are held
+// in the variables prefix0, prefix1, ...
+func (m *typeMapper) returnStmt(call string, results []ast.Expr, prefix string, wrap bool) string {
+	if len(results) == 0 {
+		return call
+	}
+
+	convert := false
+	for _, result := range results {
+		convert = convert || m.converts(result)
+	}
+	if !convert {
+		return "return " + call
+	}
+
+	vars := make([]string, len(results))
+	converted := make([]string, len(results))
+	for i, result := range results {
+		vars[i] = fmt.Sprintf("%s%d", prefix, i)
+		converted[i] = m.convert(result, vars[i], wrap)
+	}
+	return strings.Join(vars, ", ") + " := " + call + "\n" +
+		"return " + strings.Join(converted, ", ")
+}
+
+// convertArg converts the argument expr of type typ, spreading it if
+// typ is variadic.
+func (m *typeMapper) convertArg(typ ast.Expr, expr string, wrap bool) string {
+	if ellipsis, ok := typ.(*ast.Ellipsis); ok {
+		return m.convert(&ast.ArrayType{Elt: ellipsis.Elt}, expr, wrap) + "..."
+	}
+	return m.convert(typ, expr, wrap)
+}
+
+// convert returns an expression converting expr, of the wrapped
+// package's type typ, to the type the generated code uses for typ if
+// wrap is set. Otherwise, expr is of the generated code's type and is
+// converted back to typ.
+//
+// A struct is wrapped by taking its address, so expr must be a variable
+// when wrapping a struct value.
+func (m *typeMapper) convert(typ ast.Expr, expr string, wrap bool) string {
+	if !m.converts(typ) {
+		return expr
+	}
+
+	from, to := m.typeString(typ, !wrap), m.typeString(typ, wrap)
+	switch t := typ.(type) {
+	case *ast.Ident:
+		if wrap {
+			return "wrap" + t.Name + "(&" + expr + ")"
+		}
+		return "*unwrap" + t.Name + "(" + expr + ")"
+	case *ast.ParenExpr:
+		return m.convert(t.X, expr, wrap)
+	case *ast.Ellipsis:
+		return m.convert(&ast.ArrayType{Elt: t.Elt}, expr, wrap)
+	case *ast.StarExpr:
+		if ident, ok := t.X.(*ast.Ident); ok && m.isStruct(ident.Name) {
+			if wrap {
+				return "wrap" + ident.Name + "(" + expr + ")"
+			}
+			return "unwrap" + ident.Name + "(" + expr + ")"
+		}
+		return fmt.Sprintf("func(v %s) %s {\nif v == nil {\nreturn nil\n}\n"+
+			"e := *v\nc := %s\nreturn &c\n}(%s)",
+			from, to, m.convert(t.X, "e", wrap), expr)
+	case *ast.ArrayType:
+		if t.Len == nil {
+			return fmt.Sprintf("func(v %s) %s {\nif v == nil {\nreturn nil\n}\n"+
+				"c := make(%s, len(v))\nfor i := range v {\ne := v[i]\n"+
+				"c[i] = %s\n}\nreturn c\n}(%s)",
+				from, to, to, m.convert(t.Elt, "e", wrap), expr)
+		}
+		return fmt.Sprintf("func(v %s) %s {\nvar c %s\nfor i := range v {\n"+
+			"e := v[i]\nc[i] = %s\n}\nreturn c\n}(%s)",
+			from, to, to, m.convert(t.Elt, "e", wrap), expr)
+	case *ast.MapType:
+		return fmt.Sprintf("func(v %s) %s {\nif v == nil {\nreturn nil\n}\n"+
+			"c := make(%s, len(v))\nfor k, e := range v {\nk, e := k, e\n"+
+			"c[%s] = %s\n}\nreturn c\n}(%s)",
+			from, to, to, m.convert(t.Key, "k", wrap),
+			m.convert(t.Value, "e", wrap), expr)
+	case *ast.FuncType:
+		return m.convertFunc(t, expr, wrap)
+	}
+
+	return expr
+}
+
+// convertFunc returns an expression adapting the function expr of type
+// typ, as described by convert. The adapter converts its arguments the
+// opposite way to its results.
+func (m *typeMapper) convertFunc(typ *ast.FuncType, expr string, wrap bool) string {
+	var params, args []string
+	for i, param := range flattenFields(typ.Params) {
+		name := fmt.Sprintf("p%d", i)
+		params = append(params, name+" "+m.typeString(param, wrap))
+		args = append(args, m.convertArg(param, name, !wrap))
+	}
+
+	var results []string
+	resultTypes := flattenFields(typ.Results)
+	for _, result := range resultTypes {
+		results = append(results, m.typeString(result, wrap))
+	}
+
+	call := "v(" + strings.Join(args, ", ") + ")"
+	return fmt.Sprintf("func(v %s) %s {\nif v == nil {\nreturn nil\n}\n"+
+		"return func(%s) (%s) {\n%s\n}\n}(%s)",
+		m.typeString(typ, !wrap), m.typeString(typ, wrap),
+		strings.Join(params, ", "), strings.Join(results, ", "),
+		m.returnStmt(call, resultTypes, "r", wrap), expr)
+}
+
+// flattenFields returns the type of every name in fields, so a, b int
+// gives int, int.
+func flattenFields(fields *ast.FieldList) []ast.Expr {
+	if fields == nil {
+		return nil
+	}
+	var flat []ast.Expr
+	for _, field := range fields.List {
+		for i := 0; i < len(field.Names) || i == 0; i++ {
+			flat = append(flat, field.Type)
+		}
+	}
+	return flat
+}
+
+// typeString renders typ as the generated code uses it if iface is set,
+// otherwise as the wrapped package's type.
+func (m *typeMapper) typeString(typ ast.Expr, iface bool) string {
+	return types.ExprString(m.mapExpr(typ, iface))
+}
+
+// mapExpr returns a copy of the type expression expr with the wrapped
+// package's types mapped. Structs are only replaced by their interfaces
+// if iface is set and the values can be converted, so not inside
+// channels, struct and interface literals or type arguments.
+func (m *typeMapper) mapExpr(expr ast.Expr, iface bool) ast.Expr {
+	mapFields := func(fields *ast.FieldList, iface bool) *ast.FieldList {
+		if fields == nil {
+			return nil
+		}
+		mapped := &ast.FieldList{}
+		for _, field := range fields.List {
+			mapped.List = append(mapped.List, &ast.Field{
+				Names: field.Names,
+				Type:  m.mapExpr(field.Type, iface),
+			})
+		}
+		return mapped
+	}
+
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return m.mapIdent(e, iface)
+	case *ast.StarExpr:
+		// An interface already refers to the struct it wraps, so a
+		// pointer to a struct becomes its interface too.
+		if ident, ok := e.X.(*ast.Ident); ok && iface && m.isStruct(ident.Name) {
+			return m.mapIdent(ident, iface)
+		}
+		return &ast.StarExpr{X: m.mapExpr(e.X, iface)}
+	case *ast.SelectorExpr:
+		return m.mapSelector(e)
+	case *ast.IndexExpr:
+		// Instantiating a generic type with a wrapper would give a
+		// different type, so type arguments are only qualified.
+		return &ast.IndexExpr{
+			X:     m.mapExpr(e.X, false),
+			Index: m.mapExpr(e.Index, false),
+		}
+	case *ast.IndexListExpr:
+		indices := make([]ast.Expr, len(e.Indices))
+		for i, index := range e.Indices {
+			indices[i] = m.mapExpr(index, false)
+		}
+		return &ast.IndexListExpr{X: m.mapExpr(e.X, false), Indices: indices}
+	case *ast.ParenExpr:
+		return &ast.ParenExpr{X: m.mapExpr(e.X, iface)}
+	case *ast.Ellipsis:
+		return &ast.Ellipsis{Elt: m.mapExpr(e.Elt, iface)}
+	case *ast.ArrayType:
+		return &ast.ArrayType{Len: m.mapLen(e.Len), Elt: m.mapExpr(e.Elt, iface)}
+	case *ast.MapType:
+		return &ast.MapType{
+			Key:   m.mapExpr(e.Key, iface),
+			Value: m.mapExpr(e.Value, iface),
+		}
+	case *ast.ChanType:
+		return &ast.ChanType{Dir: e.Dir, Value: m.mapExpr(e.Value, false)}
+	case *ast.FuncType:
+		return &ast.FuncType{
+			Params:  mapFields(e.Params, iface),
+			Results: mapFields(e.Results, iface),
+		}
+	case *ast.StructType:
+		return &ast.StructType{Fields: mapFields(e.Fields, false)}
+	case *ast.InterfaceType:
+		return &ast.InterfaceType{Methods: mapFields(e.Methods, false)}
+	case *ast.UnaryExpr:
+		// A constraint's ~T.
+		return &ast.UnaryExpr{Op: e.Op, X: m.mapExpr(e.X, false)}
+	case *ast.BinaryExpr:
+		// A constraint's union, A | B.
+		return &ast.BinaryExpr{
+			X:  m.mapExpr(e.X, false),
+			Op: e.Op,
+			Y:  m.mapExpr(e.Y, false),
+		}
+	}
+	return expr
+}
+
+// mapIdent maps the type name ident. If iface is set, a struct is
+// replaced by its interface. Every other exported type, including local
+// interfaces, keeps referring to the source package so that values can
+// be passed through to the parent unchanged.
+func (m *typeMapper) mapIdent(ident *ast.Ident, iface bool) ast.Expr {
+	if types.Universe.Lookup(ident.Name) != nil || !ident.IsExported() ||
+		m.typeParams[ident.Name] {
+		return ident
+	}
+
+	if iface && m.isStruct(ident.Name) {
+		name := m.ifaceTypeName(ident.Name)
+		if m.ifaceName == "" {
+			return ast.NewIdent(name)
+		}
+		m.addImport(m.ifacePath, "")
+		return &ast.SelectorExpr{
+			X:   ast.NewIdent(m.ifaceName),
+			Sel: ast.NewIdent(name),
+		}
+	}
+
+	m.addImport(m.pkg.ImportPath, m.pkgName)
+	return &ast.SelectorExpr{
+		X:   ast.NewIdent(m.pkgName),
+		Sel: ast.NewIdent(ident.Name),
+	}
+}
+
+// mapLen maps the array length expr, qualifying the constants it's
+// worked out from.
+func (m *typeMapper) mapLen(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return m.mapIdent(e, false)
+	case *ast.SelectorExpr:
+		return m.mapSelector(e)
+	case *ast.ParenExpr:
+		return &ast.ParenExpr{X: m.mapLen(e.X)}
+	case *ast.UnaryExpr:
+		return &ast.UnaryExpr{Op: e.Op, X: m.mapLen(e.X)}
+	case *ast.BinaryExpr:
+		return &ast.BinaryExpr{X: m.mapLen(e.X), Op: e.Op, Y: m.mapLen(e.Y)}
+	}
+	return expr
+}
+
+// mapSelector maps sel, a type or constant from another package. It is
+// left as it is but the package it's from is imported.
+func (m *typeMapper) mapSelector(sel *ast.SelectorExpr) ast.Expr {
+	if ident, ok := sel.X.(*ast.Ident); ok {
+		if importPath, ok := m.pkg.Imports[ident.Name]; ok {
+			m.addImport(importPath, ident.Name)
+		}
+	}
+	return sel
+}
+
+// isStructValue reports whether typ is one of the package's structs,
+// rather than a pointer to one.
+func (m *typeMapper) isStructValue(typ string) bool {
+	expr, err := parseType(typ)
+	if err != nil {
+		return false
+	}
+	ident, ok := expr.(*ast.Ident)
+	return ok && m.isStruct(ident.Name)
+}
+
+func (m *typeMapper) isStruct(name string) bool {
+	return pkgContainsType(m.pkg, name)
+}
+
+// unexportedType returns the name of the first unexported local type
+// referenced by typ, or constant an array length in it uses, or "" if
+// it doesn't reference any. Such names can't be used outside of their
+// package. The names in typeParams are type parameters rather than
+// types.
+func unexportedType(typ string, typeParams map[string]bool) string {
+	var unexported string
+	rewriteType(typ, func(ident *ast.Ident) ast.Expr {
+		if unexported == "" && !ident.IsExported() &&
+			types.Universe.Lookup(ident.Name) == nil &&
+			!typeParams[ident.Name] {
+			unexported = ident.Name
+		}
+		return ident
+	})
+	return unexported
+}
+
+// parseType parses the type typ, which may be a variadic parameter's
+// type.
+func parseType(typ string) (ast.Expr, error) {
+	// A variadic parameter's type is not an expression on its own.
+	if strings.HasPrefix(typ, "...") {
+		expr, err := parser.ParseExpr(typ[len("..."):])
+		if err != nil {
+			return nil, err
+		}
+		return &ast.Ellipsis{Elt: expr}, nil
+	}
+	return parser.ParseExpr(typ)
+}
+
+// rewriteType parses typ and replaces each unqualified type name in it
+// with the result of calling rewrite on it. typ is returned unchanged
+// if it cannot be parsed.
+func rewriteType(typ string, rewrite func(*ast.Ident) ast.Expr) string {
+	expr, err := parseType(typ)
+	if err != nil {
+		return typ
+	}
+	return types.ExprString(rewriteIdents(expr, rewrite))
+}
+
+// rewriteIdents walks the type expression expr, replacing every
+// identifier naming a type with the result of calling rewrite on it.
+// Identifiers that name fields, parameters or methods, and the package
+// and selector of qualified identifiers, are left alone. The constants
+// an array's length is worked out from are replaced too.
+func rewriteIdents(expr ast.Expr, rewrite func(*ast.Ident) ast.Expr) ast.Expr {
+	rewriteFields := func(fields *ast.FieldList) {
+		if fields == nil {
+			return
+		}
+		for _, field := range fields.List {
+			field.Type = rewriteIdents(field.Type, rewrite)
+		}
+	}
+
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return rewrite(e)
+	case *ast.StarExpr:
+		e.X = rewriteIdents(e.X, rewrite)
+	case *ast.ParenExpr:
+		e.X = rewriteIdents(e.X, rewrite)
+	case *ast.Ellipsis:
+		e.Elt = rewriteIdents(e.Elt, rewrite)
+	case *ast.ArrayType:
+		e.Len = rewriteConstIdents(e.Len, rewrite)
+		e.Elt = rewriteIdents(e.Elt, rewrite)
+	case *ast.MapType:
+		e.Key = rewriteIdents(e.Key, rewrite)
+		e.Value = rewriteIdents(e.Value, rewrite)
+	case *ast.ChanType:
+		e.Value = rewriteIdents(e.Value, rewrite)
+	case *ast.FuncType:
+		rewriteFields(e.Params)
+		rewriteFields(e.Results)
+	case *ast.StructType:
+		rewriteFields(e.Fields)
+	case *ast.InterfaceType:
+		rewriteFields(e.Methods)
+	case *ast.IndexExpr:
+		e.X = rewriteIdents(e.X, rewrite)
+		e.Index = rewriteIdents(e.Index, rewrite)
+	case *ast.IndexListExpr:
+		e.X = rewriteIdents(e.X, rewrite)
+		for i, index := range e.Indices {
+			e.Indices[i] = rewriteIdents(index, rewrite)
+		}
+	}
+	return expr
+}
+
+// rewriteConstIdents walks the constant expression expr, such as an
+// array's length, replacing every unqualified identifier in it with the
+// result of calling rewrite on it.
+func rewriteConstIdents(expr ast.Expr, rewrite func(*ast.Ident) ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return rewrite(e)
+	case *ast.ParenExpr:
+		e.X = rewriteConstIdents(e.X, rewrite)
+	case *ast.UnaryExpr:
+		e.X = rewriteConstIdents(e.X, rewrite)
+	case *ast.BinaryExpr:
+		e.X = rewriteConstIdents(e.X, rewrite)
+		e.Y = rewriteConstIdents(e.Y, rewrite)
+	}
+	return expr
+}
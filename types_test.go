@@ -0,0 +1,310 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFuncResultOfLocalTypes(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type Req struct{ ID int }
+
+type Resp struct{ Body string }
+
+type Server struct{}
+
+func (s *Server) Handler() func(*Req) *Resp { return nil }
+`, nil)
+
+	testContains(t, fooIface, files[fooIface], "Handler() func(Req) Resp\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *Server) Handler() func(fooiface.Req) fooiface.Resp {",
+		"r0 := v(unwrapReq(p0))", "return wrapResp(r0)")
+}
+
+func TestVariadicNamedResultsOfLocalTypes(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Item struct{ Key string }
+
+type Store struct{}
+
+func (s *Store) Put(prefix string, items ...*Item) (keys string, err error) {
+	for _, item := range items {
+		keys += prefix + item.Key
+	}
+	return keys, nil
+}
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	testContains(t, fooIface, files[fooIface],
+		"Put(prefix string, items ...Item) (keys string, err error)\n")
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	srcfoo "example.com/foo"
+	"example.com/out/foo"
+	"example.com/out/fooiface"
+)
+
+func main() {
+	var s fooiface.Store = foo.NewStore(&srcfoo.Store{})
+	items := []fooiface.Item{
+		foo.NewItem(&srcfoo.Item{Key: "a"}),
+		foo.NewItem(&srcfoo.Item{Key: "b"}),
+	}
+	fmt.Println(s.Put("/", items...))
+	fmt.Println(s.Put("/"))
+}
+`)
+	if want := "/a/b <nil>\n <nil>\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestLocalStructResultByValue(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Config struct{ Addr string }
+
+type Server struct{ addr string }
+
+func (s *Server) Config() Config { return Config{Addr: s.addr} }
+
+func New(addr string) *Server { return &Server{addr: addr} }
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	testContains(t, fooIface, files[fooIface], "\tConfig() Config\n")
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	"example.com/out/foo"
+)
+
+func main() {
+	fmt.Println(foo.New(":80").Config().Addr())
+}
+`)
+	if out != ":80\n" {
+		t.Errorf("got %q, want :80", out)
+	}
+}
+
+func TestLocalInterfaceParam(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+type Doer interface{ Do() error }
+
+type Server struct{}
+
+func (s *Server) Use(d Doer) Doer { return d }
+`, nil)
+
+	// Local interfaces are used as they are, so they're passed straight
+	// through.
+	testContains(t, fooIface, files[fooIface], "\tUse(d foo.Doer) foo.Doer\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *Server) Use(d foo.Doer) foo.Doer {\n\treturn x.parent.Use(d)\n}")
+}
+
+func TestForeignPointerField(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+import "net/http"
+
+type API struct{ Client *http.Client }
+`, nil)
+
+	testContains(t, fooIface, files[fooIface], "\t\"net/http\"\n",
+		"\tClient() *http.Client\n")
+	testContains(t, fooImpl, files[fooImpl], "\t\"net/http\"\n",
+		"func (x *API) Client() *http.Client {\n\treturn x.parent.Client\n}")
+}
+
+func TestVariadicLocalType(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Item struct{ Key string }
+
+type Set struct{}
+
+func (s *Set) Add(items ...Item) string {
+	var keys string
+	for _, item := range items {
+		keys += item.Key
+	}
+	return keys
+}
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	testContains(t, fooIface, files[fooIface], "\tAdd(items ...Item) string\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"func (x *Set) Add(items ...fooiface.Item) string {", "}(items)...)")
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	srcfoo "example.com/foo"
+	"example.com/out/foo"
+)
+
+func main() {
+	set := foo.NewSet(&srcfoo.Set{})
+	fmt.Println(set.Add(foo.NewItem(&srcfoo.Item{Key: "a"}),
+		foo.NewItem(&srcfoo.Item{Key: "b"})))
+}
+`)
+	if out != "ab\n" {
+		t.Errorf("got %q, want ab", out)
+	}
+}
+
+func TestUnsafePointerField(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+import "unsafe"
+
+type Buffer struct{ Data unsafe.Pointer }
+`, nil)
+
+	for _, name := range []string{fooIface, fooImpl} {
+		testContains(t, name, files[name], "\t\"unsafe\"\n",
+			"Data() unsafe.Pointer")
+	}
+}
+
+func TestOwnInterfaceParam(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+type Store interface{ Get(key string) string }
+
+type Server struct{ store Store }
+
+func (s *Server) SetStore(st Store) { s.store = st }
+
+func (s *Server) Store() Store { return s.store }
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	// The package's own interfaces aren't re-exported, so they're used
+	// as they are on both sides of the wrapper.
+	testContains(t, fooIface, files[fooIface],
+		"\tSetStore(st foo.Store)\n", "\tStore() foo.Store\n")
+	if strings.Contains(files[fooIface], "type Store interface") {
+		t.Errorf("Store is re-exported:\n%s", files[fooIface])
+	}
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	srcfoo "example.com/foo"
+	"example.com/out/foo"
+)
+
+type store struct{}
+
+func (store) Get(key string) string { return "value of " + key }
+
+func main() {
+	s := foo.NewServer(&srcfoo.Server{})
+	s.SetStore(store{})
+	fmt.Println(s.Store().Get("k"))
+}
+`)
+	if out != "value of k\n" {
+		t.Errorf("got %q, want the value from the store that was set", out)
+	}
+}
+
+func TestSeveralLocalResults(t *testing.T) {
+	gopath := testGopath(t, map[string]map[string]string{
+		"example.com/foo": {"foo.go": `package foo
+
+import "errors"
+
+type Left struct{ Name string }
+
+type Right struct{ Name string }
+
+type S struct{}
+
+func (s *S) Split() (*Left, *Right, error) {
+	return &Left{Name: "l"}, &Right{Name: "r"}, errors.New("split")
+}
+`},
+	})
+	files := testGenerate(t, testOptions(gopath, "example.com/foo"))
+
+	testContains(t, fooIface, files[fooIface], "\tSplit() (Left, Right, error)\n")
+	testContains(t, fooImpl, files[fooImpl],
+		"return wrapLeft(r0), wrapRight(r1), r2\n")
+	out := testRun(t, gopath, files, `package main
+
+import (
+	"fmt"
+
+	srcfoo "example.com/foo"
+	"example.com/out/foo"
+)
+
+func main() {
+	l, r, err := foo.NewS(&srcfoo.S{}).Split()
+	fmt.Println(l.Name(), r.Name(), err)
+}
+`)
+	if out != "l r split\n" {
+		t.Errorf("got %q, want l r split", out)
+	}
+}
+
+func TestStdlibInterfaceParams(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+import "io"
+
+type S struct{}
+
+func (s *S) Copy(w io.Writer) (int64, error) { return 0, nil }
+
+func (s *S) Body() io.Reader { return nil }
+`, nil)
+
+	for _, name := range []string{fooIface, fooImpl} {
+		testContains(t, name, files[name], "\t\"io\"\n",
+			"Copy(w io.Writer) (int64, error)", "Body() io.Reader")
+	}
+}
+
+func TestForeignEmbeddedStruct(t *testing.T) {
+	files := testGenerateFoo(t, `package foo
+
+import "bytes"
+
+type Log struct {
+	bytes.Buffer
+	Name string
+}
+`, nil)
+
+	testContains(t, fooIface, files[fooIface], "\t\"io\"\n",
+		"\tWrite(p []byte) (n int, err error)\n", "\tString() string\n",
+		"\tWriteTo(w io.Writer) (n int64, err error)\n")
+}
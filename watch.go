@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// pollInterval is how often watchInput checks the input package for
+// changes.
+const pollInterval = 500 * time.Millisecond
+
+// watchInput generates the packages described by opts, then regenerates
+// them whenever the source files of the input package change, until the
+// process is killed. Changes are debounced by waiting for the files to
+// stop changing for a poll interval. Errors are reported and watching
+// carries on, so a half-edited file doesn't end the session.
+func watchInput(opts Options, timeout time.Duration, mode outputMode) {
+	regenerate := func() {
+		start := time.Now()
+		if err := run(opts, timeout, mode); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		log.Printf("regenerated %s in %s", opts.Input,
+			time.Since(start).Round(time.Millisecond))
+	}
+
+	last := inputModTimes(opts)
+	regenerate()
+
+	changed := false
+	for range time.Tick(pollInterval) {
+		current := inputModTimes(opts)
+		if !sameModTimes(last, current) {
+			last = current
+			changed = true
+			continue
+		}
+		if changed {
+			changed = false
+			regenerate()
+		}
+	}
+}
+
+// inputModTimes returns the modification times of the source files of
+// the input package. Files that can't be listed or stat-ed are left
+// out, they show up as a change once they can be.
+func inputModTimes(opts Options) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	fileNames, err := pkgFiles(opts.Input, opts.Overlay)
+	if err != nil {
+		return modTimes
+	}
+	for _, fileName := range fileNames {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			continue
+		}
+		modTimes[fileName] = info.ModTime()
+	}
+	return modTimes
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for fileName, modTime := range a {
+		if other, ok := b[fileName]; !ok || !other.Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}